@@ -15,6 +15,7 @@ func NewAudioCapture() *ControlledCapture {
 	config := utils.GetMediaConfig()
 	e := &emitter.Emitter{}
 	e.Use("*", emitter.Void)
+	log.Info().Str("pipeline", config.AudioPipeline).Msg("Creating the audio pipeline")
 	gst.Init(nil)
 	pipeline, err := gst.NewPipelineFromString(config.AudioPipeline)
 	if err != nil {
@@ -22,13 +23,7 @@ func NewAudioCapture() *ControlledCapture {
 		os.Exit(2)
 	}
 
-	sink_el, _ := pipeline.GetElementByName("appsink")
-
-	sink := app.SinkFromElement(sink_el)
-	if err != nil {
-		log.Err(err).Msg("Failed to create sink")
-		os.Exit(2)
-	}
+	sink := pipelineSink(pipeline)
 
 	var samples = 0
 	var buffer_len = int64(0)
@@ -1,14 +1,26 @@
 package capture
 
 import (
+	"sync"
+	"time"
+
 	"github.com/olebedev/emitter"
+	"github.com/rs/zerolog/log"
 	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
 )
 
+// the encoders are forced to produce a keyframe at most this often
+const keyframeRequestInterval = 500 * time.Millisecond
+
 type ControlledCapture struct {
 	*emitter.Emitter
 	pipeline *gst.Pipeline
 	counter  int
+	// sets the bitrate of the encoder, nil if it can't be changed
+	setBitrate func(bitrate int)
+	// forces a keyframe from the encoder of the simulcast layer ("" for the full resolution), nil without encoder
+	requestKeyframe func(rid string)
 }
 
 func (c *ControlledCapture) Start() {
@@ -19,12 +31,111 @@ func (c *ControlledCapture) Stop() {
 	c.pipeline.SetState(gst.StateNull)
 }
 
+// SetBitrate changes the bitrate of the running encoder, in bits per second
+func (c *ControlledCapture) SetBitrate(bitrate int) {
+	if c.setBitrate != nil {
+		c.setBitrate(bitrate)
+	}
+}
+
+// RequestKeyframe forces a keyframe from the encoder, on the PLI/FIR of the viewers
+func (c *ControlledCapture) RequestKeyframe() {
+	c.RequestLayerKeyframe("")
+}
+
+// RequestLayerKeyframe forces a keyframe from the encoder of a lower simulcast layer
+func (c *ControlledCapture) RequestLayerKeyframe(rid string) {
+	if c.requestKeyframe != nil {
+		c.requestKeyframe(rid)
+	}
+}
+
+// newKeyframeRequester sends force-key-unit events to the encoder, the requests of the viewers arriving
+// within keyframeRequestInterval of the last keyframe are coalesced into one
+func newKeyframeRequester(encoder *gst.Element) func() {
+	var mutex sync.Mutex
+	var lastForced time.Time
+	pending := false
+
+	force := func() {
+		structure := gst.NewStructure("GstForceKeyUnit")
+		structure.SetValue("running-time", uint64(0xffffffffffffffff))
+		structure.SetValue("all-headers", true)
+		structure.SetValue("count", uint(0))
+		// an upstream event sent to the encoder is handled by its src pad
+		if !encoder.SendEvent(gst.NewCustomEvent(gst.EventTypeCustomUpstream, structure)) {
+			log.Warn().Str("encoder", encoder.GetName()).Msg("the encoder didn't handle the keyframe request")
+		}
+	}
+
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if pending {
+			return
+		}
+		wait := keyframeRequestInterval - time.Since(lastForced)
+		if wait <= 0 {
+			lastForced = time.Now()
+			force()
+			return
+		}
+		pending = true
+		time.AfterFunc(wait, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			pending = false
+			lastForced = time.Now()
+			force()
+		})
+	}
+}
+
+// returns the appsink of the pipeline, the custom pipelines of the config are validated by it
+func pipelineSink(pipeline *gst.Pipeline) *app.Sink {
+	sink_el, err := pipeline.GetElementByName("appsink")
+	if err != nil || sink_el.GetFactory().GetName() != "appsink" {
+		log.Fatal().Msg("The pipeline needs an appsink named appsink")
+	}
+	return app.SinkFromElement(sink_el)
+}
+
+// emits the buffers pulled from the appsink
+func sinkCallbacks(emit func(buffer *gst.Buffer)) *app.SinkCallbacks {
+	return &app.SinkCallbacks{
+		NewSampleFunc: func(sink *app.Sink) gst.FlowReturn {
+			sample := sink.PullSample()
+			if sample == nil {
+				return gst.FlowEOS
+			}
+
+			buffer := sample.GetBuffer()
+			if buffer == nil {
+				return gst.FlowError
+			}
+
+			emit(buffer)
+
+			return gst.FlowOK
+		},
+	}
+}
+
 func (c *ControlledCapture) GetChannel() (channel chan *gst.Buffer, cleanup func()) {
+	return c.getChannel("data")
+}
+
+// GetLayerChannel returns the buffers of a lower simulcast layer
+func (c *ControlledCapture) GetLayerChannel(rid string) (channel chan *gst.Buffer, cleanup func()) {
+	return c.getChannel("data_" + rid)
+}
+
+func (c *ControlledCapture) getChannel(event string) (channel chan *gst.Buffer, cleanup func()) {
 	c.counter++
 	channel = make(chan *gst.Buffer, 2)
 	writing := false
 
-	subscription := c.On("data", func(e *emitter.Event) {
+	subscription := c.On(event, func(e *emitter.Event) {
 		if writing {
 			return
 		}
@@ -34,7 +145,7 @@ func (c *ControlledCapture) GetChannel() (channel chan *gst.Buffer, cleanup func
 	})
 
 	cleanup = func() {
-		c.Off("data", subscription)
+		c.Off(event, subscription)
 		close(channel)
 		c.counter--
 		if c.counter <= 0 {
@@ -0,0 +1,74 @@
+package capture
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+)
+
+// the config of the test sources, loaded once by the utils package
+const testConfig = `{
+  "settings": {
+    "stream_id": "capture_test",
+    "resolution": "320x240",
+    "framerate": 30,
+    "encoder": "vp8",
+    "threads": 1,
+    "bitrate": 500000,
+    "source": "test"
+  }
+}`
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "capture_test")
+	if err != nil {
+		panic(err)
+	}
+	configPath := path.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, []byte(testConfig), 0644); err != nil {
+		panic(err)
+	}
+	os.Setenv("CONFIG_PATH", configPath)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// skips the test if an element of the pipeline isn't installed
+func requireElements(t *testing.T, elements ...string) {
+	gst.Init(nil)
+	for _, element := range elements {
+		if gst.Find(element) == nil {
+			t.Skipf("the GStreamer element %s isn't installed", element)
+		}
+	}
+}
+
+// starts the capture and waits for the first encoded buffer of the appsink
+func pullBuffer(t *testing.T, capture *ControlledCapture) {
+	channel, cleanup := capture.GetChannel()
+	defer cleanup()
+
+	select {
+	case buffer := <-channel:
+		if buffer.GetSize() == 0 {
+			t.Error("pulled an empty buffer")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no buffer pulled from the appsink")
+	}
+}
+
+func TestVideoTestSource(t *testing.T) {
+	requireElements(t, "videotestsrc", "timeoverlay", "videoconvert", "queue2", "vp8enc", "appsink")
+	pullBuffer(t, NewVideoCapture())
+}
+
+func TestAudioTestSource(t *testing.T) {
+	requireElements(t, "audiotestsrc", "audioconvert", "queue2", "opusenc", "appsink")
+	pullBuffer(t, NewAudioCapture())
+}
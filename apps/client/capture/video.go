@@ -13,24 +13,32 @@ import (
 )
 
 func NewVideoCapture() *ControlledCapture {
-	config := utils.GetMediaConfig()
+	return newVideoCapture(utils.GetMediaConfig().VideoPipeline)
+}
+
+// NewFallbackVideoCapture captures the H264 video for the viewers not supporting the codec of the encoder,
+// nil if the encoder doesn't need a fallback
+func NewFallbackVideoCapture() *ControlledCapture {
+	videoPipeline := utils.GetMediaConfig().FallbackVideoPipeline
+	if videoPipeline == "" {
+		return nil
+	}
+	return newVideoCapture(videoPipeline)
+}
+
+func newVideoCapture(videoPipeline string) *ControlledCapture {
 	e := &emitter.Emitter{}
 	e.Use("*", emitter.Void)
 
+	log.Info().Str("pipeline", videoPipeline).Msg("Creating the video pipeline")
 	gst.Init(nil)
-	pipeline, err := gst.NewPipelineFromString(config.VideoPipeline)
+	pipeline, err := gst.NewPipelineFromString(videoPipeline)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(2)
 	}
 
-	sink_el, _ := pipeline.GetElementByName("appsink")
-
-	sink := app.SinkFromElement(sink_el)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(2)
-	}
+	sink := pipelineSink(pipeline)
 
 	var frames = 0
 	var buffer_len = int64(0)
@@ -56,32 +64,67 @@ func NewVideoCapture() *ControlledCapture {
 		}
 	}()
 
-	sink.SetCallbacks(&app.SinkCallbacks{
-		NewSampleFunc: func(sink *app.Sink) gst.FlowReturn {
-			sample := sink.PullSample()
-			if sample == nil {
-				return gst.FlowEOS
-			}
+	sink.SetCallbacks(sinkCallbacks(func(buffer *gst.Buffer) {
+		len := buffer.GetSize()
 
-			buffer := sample.GetBuffer()
-			if buffer == nil {
-				return gst.FlowError
-			}
+		frames++
+		buffer_len += len
 
-			len := buffer.GetSize()
+		e.Emit("data", buffer)
+	}))
 
-			frames++
-			buffer_len += len
+	encoders := map[*gst.Element]int{}
+	keyframeRequesters := map[string]func(){}
+	if encoder_el, err := pipeline.GetElementByName("encoder"); err == nil {
+		encoders[encoder_el] = 1
+		keyframeRequesters[""] = newKeyframeRequester(encoder_el)
+	} else {
+		// a custom pipeline may not name its encoder
+		log.Warn().Msg("The video pipeline has no element named encoder, the bitrate isn't adapted and the keyframe requests are ignored")
+	}
+
+	// the lower simulcast layers are encoded by the same pipeline
+	for _, layer := range utils.GetSimulcastLayers() {
+		layer_encoder_el, err := pipeline.GetElementByName("encoder_" + layer.Rid)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		encoders[layer_encoder_el] = layer.Scale * layer.Scale
+		keyframeRequesters[layer.Rid] = newKeyframeRequester(layer_encoder_el)
 
-			e.Emit("data", buffer)
+		layer_sink_el, err := pipeline.GetElementByName("appsink_" + layer.Rid)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		event := "data_" + layer.Rid
+		app.SinkFromElement(layer_sink_el).SetCallbacks(sinkCallbacks(func(buffer *gst.Buffer) {
+			e.Emit(event, buffer)
+		}))
+	}
 
-			return gst.FlowOK
-		},
-	})
+	// the lower layers get the bitrate divided by the square of their scale, like at startup
+	setBitrate := func(bitrate int) {
+		for el, divisor := range encoders {
+			property, value := utils.EncoderBitrate(el.GetFactory().GetName(), bitrate/divisor)
+			if err := el.SetProperty(property, value); err != nil {
+				log.Err(err).Str("encoder", el.GetName()).Msg("failed to set the encoder bitrate")
+			}
+		}
+	}
+
+	requestKeyframe := func(rid string) {
+		if requester, ok := keyframeRequesters[rid]; ok {
+			requester()
+		}
+	}
 
 	return &ControlledCapture{
-		Emitter:  e,
-		counter:  0,
-		pipeline: pipeline,
+		Emitter:         e,
+		counter:         0,
+		pipeline:        pipeline,
+		setBitrate:      setBitrate,
+		requestKeyframe: requestKeyframe,
 	}
 }
@@ -4,10 +4,12 @@ go 1.18
 
 require (
 	github.com/go-vgo/robotgo v0.100.10
+	github.com/gorilla/websocket v1.4.2
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/olebedev/emitter v0.0.0-20190110104742-e8d1457e6aee
-	github.com/pion/interceptor v0.1.7
-	github.com/pion/webrtc/v3 v3.1.24
+	github.com/pion/interceptor v0.1.10
+	github.com/pion/rtcp v1.2.9
+	github.com/pion/webrtc/v3 v3.1.29
 	github.com/robotn/gohook v0.31.3
 	github.com/rs/zerolog v1.26.1
 	github.com/tinyzimmer/go-gst v0.2.32
@@ -33,12 +35,11 @@ require (
 	github.com/otiai10/gosseract v2.2.1+incompatible // indirect
 	github.com/pion/datachannel v1.5.2 // indirect
 	github.com/pion/dtls/v2 v2.1.3 // indirect
-	github.com/pion/ice/v2 v2.2.1 // indirect
+	github.com/pion/ice/v2 v2.2.3 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.5 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.9 // indirect
-	github.com/pion/rtp v1.7.4 // indirect
+	github.com/pion/rtp v1.7.13 // indirect
 	github.com/pion/sctp v1.8.2 // indirect
 	github.com/pion/sdp/v3 v3.0.4 // indirect
 	github.com/pion/srtp/v2 v2.0.5 // indirect
@@ -232,7 +232,16 @@ func SetupRemote(peerConnection *rtc.PeerConnection) {
 			}
 		})
 
+		sessionStarted := false
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			// the first command of the viewer starts the remote control session
+			if config.RemoteEnabled && !sessionStarted {
+				sessionStarted = true
+				go rtc.SendViewerConnectionEvent(rtc.ViewerConnectionEvent{
+					Type:     "remote_session_started",
+					ViewerId: peerConnection.ViewerId,
+				})
+			}
 			e.Emit("input", msg.Data)
 		})
 
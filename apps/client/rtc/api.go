@@ -1,36 +1,90 @@
 package rtc
 
 import (
+	"client/utils"
+
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
 	"github.com/pion/webrtc/v3"
 )
 
-func SetupApi() *webrtc.API {
+// the payload types of the H264 profiles, the encoders produce one of them
+var h264Profiles = []struct {
+	name        string
+	payloadType webrtc.PayloadType
+}{
+	{"baseline", 102},
+	{"main", 104},
+	{"high", 106},
+}
+
+// the level of the stream may be higher than the negotiated one
+func h264FmtpLine(profileLevelId string) string {
+	return "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profileLevelId
+}
+
+// vp9enc encodes the 8 bit 4:2:0 profile
+const vp9FmtpLine = "profile-id=0"
+
+// SetupApi creates the api of a peer connection, onEstimator receives the send side bandwidth estimator of the connection
+func SetupApi(onEstimator func(estimator cc.BandwidthEstimator)) *webrtc.API {
 	engine := &webrtc.MediaEngine{}
 
 	// Register Interceptors
 	i := &interceptor.Registry{}
 
-	err := webrtc.RegisterDefaultInterceptors(engine, i)
+	err := webrtc.ConfigureNack(engine, i)
 	if err != nil {
 		panic(err)
 	}
-	fb := []webrtc.RTCPFeedback{}
-	err = engine.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeH264,
-			ClockRate:    90000,
-			Channels:     0,
-			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-			RTCPFeedback: fb,
-		},
-		PayloadType: 102,
-	},
-		webrtc.RTPCodecTypeVideo)
+	if err = webrtc.ConfigureRTCPReports(i); err != nil {
+		panic(err)
+	}
 
+	// the viewers (the server in SFU mode) send TWCC feedback for the transport-wide sequence numbers,
+	// the google congestion control estimates the bandwidth from it
+	if err = webrtc.ConfigureTWCCHeaderExtensionSender(engine, i); err != nil {
+		panic(err)
+	}
+	initialBitrate := int(float64(utils.GetConfig().Bitrate) * utils.SimulcastBitrateShare())
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// the encoder adapts to the estimate, the packets aren't paced
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(initialBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
 	if err != nil {
 		panic(err)
 	}
+	congestionController.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		onEstimator(estimator)
+	})
+	i.Add(congestionController)
+
+	fb := []webrtc.RTCPFeedback{}
+	videoFb := []webrtc.RTCPFeedback{
+		{Type: "transport-cc"},
+		{Type: "goog-remb"},
+		{Type: "nack"},
+		{Type: "nack", Parameter: "pli"},
+		{Type: "ccm", Parameter: "fir"},
+	}
+	for _, profile := range h264Profiles {
+		err = engine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    90000,
+				Channels:     0,
+				SDPFmtpLine:  h264FmtpLine(utils.H264ProfileLevelIds[profile.name]),
+				RTCPFeedback: videoFb,
+			},
+			PayloadType: profile.payloadType,
+		},
+			webrtc.RTPCodecTypeVideo)
+
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	err = engine.RegisterCodec(
 		webrtc.RTPCodecParameters{
@@ -39,7 +93,7 @@ func SetupApi() *webrtc.API {
 				ClockRate:    90000,
 				Channels:     0,
 				SDPFmtpLine:  "",
-				RTCPFeedback: fb,
+				RTCPFeedback: videoFb,
 			},
 			PayloadType: 96,
 		},
@@ -50,6 +104,42 @@ func SetupApi() *webrtc.API {
 		panic(err)
 	}
 
+	err = engine.RegisterCodec(
+		webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeVP9,
+				ClockRate:    90000,
+				Channels:     0,
+				SDPFmtpLine:  vp9FmtpLine,
+				RTCPFeedback: videoFb,
+			},
+			PayloadType: 98,
+		},
+		webrtc.RTPCodecTypeVideo,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = engine.RegisterCodec(
+		webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeAV1,
+				ClockRate:    90000,
+				Channels:     0,
+				SDPFmtpLine:  "",
+				RTCPFeedback: videoFb,
+			},
+			PayloadType: 100,
+		},
+		webrtc.RTPCodecTypeVideo,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
 	err = engine.RegisterCodec(
 		webrtc.RTPCodecParameters{
 			RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -0,0 +1,126 @@
+package rtc
+
+import (
+	"client/utils"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// the encoder bitrate is changed if the estimate differs from it by more than this share
+	bitrateChangeThreshold = 0.05
+	// the encoder bitrate is increased at most this often, decreased immediately
+	bitrateIncreaseInterval = time.Second
+)
+
+// the bandwidth estimate of a connection, the lower of the TWCC (send side) and REMB (receive side) estimates
+type bandwidthEstimate struct {
+	twcc  int
+	remb  int
+	mutex sync.Mutex
+}
+
+// setTWCC stores the send side estimate and returns the estimate of the connection
+func (estimate *bandwidthEstimate) setTWCC(bitrate int) int {
+	estimate.mutex.Lock()
+	defer estimate.mutex.Unlock()
+	estimate.twcc = bitrate
+	return estimate.get()
+}
+
+// setREMB stores the estimate of the receiver and returns the estimate of the connection
+func (estimate *bandwidthEstimate) setREMB(bitrate int) int {
+	estimate.mutex.Lock()
+	defer estimate.mutex.Unlock()
+	estimate.remb = bitrate
+	return estimate.get()
+}
+
+func (estimate *bandwidthEstimate) get() int {
+	if estimate.remb != 0 && (estimate.twcc == 0 || estimate.remb < estimate.twcc) {
+		return estimate.remb
+	}
+	return estimate.twcc
+}
+
+type BitrateController struct {
+	Update func(viewerId string, bitrate int)
+	Remove func(viewerId string)
+}
+
+// NewBitrateController sets the encoder bitrate to the lowest bandwidth estimate of the connections,
+// between the min_bitrate and max_bitrate of the config
+func NewBitrateController(setBitrate func(bitrate int)) *BitrateController {
+	config := utils.GetConfig()
+	// the estimates are shared by the simulcast layers, the bitrates are of the full resolution layer
+	share := utils.SimulcastBitrateShare()
+
+	estimates := make(map[string]int)
+	current := config.Bitrate
+	increasedAt := time.Time{}
+	var mutex sync.Mutex
+
+	apply := func() {
+		if len(estimates) == 0 {
+			return
+		}
+		lowest := 0
+		for _, estimate := range estimates {
+			if lowest == 0 || estimate < lowest {
+				lowest = estimate
+			}
+		}
+		target := int(float64(lowest) / share)
+		if target < config.MinBitrate {
+			target = config.MinBitrate
+		}
+		if target > config.MaxBitrate {
+			target = config.MaxBitrate
+		}
+
+		change := float64(target-current) / float64(current)
+		if change > -bitrateChangeThreshold && change < bitrateChangeThreshold && target != config.MinBitrate && target != config.MaxBitrate {
+			return
+		}
+		if target == current || (target > current && time.Since(increasedAt) < bitrateIncreaseInterval) {
+			return
+		}
+		if target > current {
+			increasedAt = time.Now()
+		}
+
+		log.Info().
+			Int("from", current).
+			Int("to", target).
+			Int("estimate", lowest).
+			Msg("changing the encoder bitrate")
+
+		current = target
+		setBitrate(target)
+	}
+
+	return &BitrateController{
+		Update: func(viewerId string, bitrate int) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			estimates[viewerId] = bitrate
+			apply()
+		},
+		Remove: func(viewerId string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			delete(estimates, viewerId)
+			if len(estimates) == 0 {
+				// the next viewer starts with the configured bitrate, like the estimator
+				if current != config.Bitrate {
+					current = config.Bitrate
+					setBitrate(current)
+				}
+				return
+			}
+			apply()
+		},
+	}
+}
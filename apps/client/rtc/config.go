@@ -9,27 +9,48 @@ import (
 
 type RtcConfig struct {
 	VideoMimeType string
-	AudioMimeType string
+	// selects the negotiated H264 profile of the encoder
+	VideoFmtpLine string
+	// the H264 video for the viewers not supporting the codec of the encoder, empty without fallback
+	FallbackMimeType string
+	FallbackFmtpLine string
+	AudioMimeType    string
+}
+
+// returns the mime type and the fmtp line of the video track of the encoder
+func encoderCodec(encoder string) (string, string) {
+	switch encoder {
+	case "vp8":
+		return webrtc.MimeTypeVP8, ""
+	case "vp9":
+		return webrtc.MimeTypeVP9, vp9FmtpLine
+	case "av1":
+		return webrtc.MimeTypeAV1, ""
+	case "h264", "nvenc":
+		return webrtc.MimeTypeH264, h264FmtpLine(utils.H264ProfileLevelIds["baseline"])
+	case "x264":
+		return webrtc.MimeTypeH264, h264FmtpLine(utils.H264ProfileLevelIds[utils.GetConfig().X264Profile])
+	}
+	log.Fatal().Msg("Invalid encoder specified")
+	return "", ""
 }
 
 func GetRtcConfig() RtcConfig {
 	config := utils.GetConfig()
 
-	var videoMimeType string
-	switch config.Encoder {
-	case "vp8":
-		videoMimeType = webrtc.MimeTypeVP8
-	case "h264":
-		videoMimeType = webrtc.MimeTypeH264
-	case "nvenc":
-		videoMimeType = webrtc.MimeTypeH264
-	default:
-		log.Fatal().Msg("Invalid encoder specified")
+	videoMimeType, videoFmtpLine := encoderCodec(config.Encoder)
+	var fallbackMimeType string
+	var fallbackFmtpLine string
+	if config.FallbackEncoder != "none" {
+		fallbackMimeType, fallbackFmtpLine = encoderCodec(config.FallbackEncoder)
 	}
 	audioMimeType := webrtc.MimeTypeOpus
 	return RtcConfig{
 
-		VideoMimeType: videoMimeType,
-		AudioMimeType: audioMimeType,
+		VideoMimeType:    videoMimeType,
+		VideoFmtpLine:    videoFmtpLine,
+		FallbackMimeType: fallbackMimeType,
+		FallbackFmtpLine: fallbackFmtpLine,
+		AudioMimeType:    audioMimeType,
 	}
 }
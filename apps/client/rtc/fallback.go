@@ -0,0 +1,34 @@
+package rtc
+
+import (
+	"errors"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// fallbackTrack is bound as the video track of the encoder, or as the fallback track
+// if the viewer didn't offer the codec of the encoder (direct connect only, the server selects it otherwise)
+type fallbackTrack struct {
+	webrtc.TrackLocal
+	fallback webrtc.TrackLocal
+	// called before binding the fallback track
+	onFallback  func()
+	useFallback bool
+}
+
+func (track *fallbackTrack) Bind(trackContext webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := track.TrackLocal.Bind(trackContext)
+	if !errors.Is(err, webrtc.ErrUnsupportedCodec) {
+		return codec, err
+	}
+	track.useFallback = true
+	track.onFallback()
+	return track.fallback.Bind(trackContext)
+}
+
+func (track *fallbackTrack) Unbind(trackContext webrtc.TrackLocalContext) error {
+	if track.useFallback {
+		return track.fallback.Unbind(trackContext)
+	}
+	return track.TrackLocal.Unbind(trackContext)
+}
@@ -0,0 +1,102 @@
+package rtc
+
+import (
+	"client/utils"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// the credentials are refreshed this long before they expire
+const iceServersRefreshMargin = time.Minute
+
+var (
+	iceServers      []webrtc.ICEServer
+	iceServersMutex sync.Mutex
+	// the refresh loop is started by the first connection
+	iceServersOnce sync.Once
+)
+
+// fetches the ice servers from the signaling server,
+// returns when the earliest short-lived credential expires, zero if none of them expires
+func fetchIceServers() ([]webrtc.ICEServer, time.Time, error) {
+	config := utils.GetConfig()
+	client := resty.New()
+	res, err := client.R().
+		SetHeader("Accept", "application/json").
+		Get(fmt.Sprintf("%s/ice-config", config.SignalingServer))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	parsed := utils.ParseJson[[]ICEServer](res)
+	if parsed.Error != nil {
+		return nil, time.Time{}, parsed.Error
+	}
+
+	expiresAt := time.Time{}
+	parsedServers := make([]webrtc.ICEServer, len(parsed.Value))
+	for i, iceServer := range parsed.Value {
+		parsedServers[i] = webrtc.ICEServer{
+			URLs:           iceServer.URLs,
+			Username:       iceServer.Username,
+			Credential:     iceServer.Credential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		}
+		if iceServer.ExpiresAt != 0 {
+			serverExpiresAt := time.Unix(iceServer.ExpiresAt, 0)
+			if expiresAt.IsZero() || serverExpiresAt.Before(expiresAt) {
+				expiresAt = serverExpiresAt
+			}
+		}
+	}
+	return parsedServers, expiresAt, nil
+}
+
+func refreshIceServers() time.Time {
+	servers, expiresAt, err := fetchIceServers()
+	if err != nil {
+		log.Err(err).Msg("failed to get the ice servers")
+		return time.Time{}
+	}
+	log.Info().Msgf("Got ice servers: %+v", servers)
+	iceServersMutex.Lock()
+	iceServers = servers
+	iceServersMutex.Unlock()
+	return expiresAt
+}
+
+// keeps the short-lived TURN credentials valid
+func refreshIceServersLoop(expiresAt time.Time) {
+	for {
+		wait := time.Until(expiresAt) - iceServersRefreshMargin
+		if expiresAt.IsZero() {
+			// retry if the fetch failed, static credentials are fetched again occasionally
+			wait = time.Minute * 5
+			iceServersMutex.Lock()
+			if iceServers == nil {
+				wait = time.Second * 5
+			}
+			iceServersMutex.Unlock()
+		} else if wait < time.Second*5 {
+			wait = time.Second * 5
+		}
+		time.Sleep(wait)
+		expiresAt = refreshIceServers()
+	}
+}
+
+// GetIceServers returns the cached ice servers of the signaling server
+func GetIceServers() []webrtc.ICEServer {
+	iceServersOnce.Do(func() {
+		expiresAt := refreshIceServers()
+		go refreshIceServersLoop(expiresAt)
+	})
+	iceServersMutex.Lock()
+	defer iceServersMutex.Unlock()
+	return iceServers
+}
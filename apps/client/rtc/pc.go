@@ -3,21 +3,24 @@ package rtc
 import (
 	"client/utils"
 	"fmt"
+	"strings"
 
-	"github.com/go-resty/resty/v2"
 	"github.com/olebedev/emitter"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v3"
 	"github.com/rs/zerolog/log"
 )
 
 type PeerConnection struct {
-	ViewerId          string
-	OnSignal          func(cb func(signal Signal))
-	Signal            func(signal Signal) error
-	OnConnected       func(cb func())
-	OnDisconnected    func(cb func())
-	AddTracks         func(tracks *Tracks)
-	PendingCandidates []*webrtc.ICECandidate
+	ViewerId            string
+	OnSignal            func(cb func(signal Signal))
+	Signal              func(signal Signal) error
+	OnConnected         func(cb func())
+	OnDisconnected      func(cb func())
+	OnBandwidthEstimate func(cb func(bitrate int))
+	AddTracks           func(tracks *Tracks)
+	PendingCandidates   []*webrtc.ICECandidate
+	estimate            *bandwidthEstimate
 	*webrtc.PeerConnection
 	*emitter.Emitter
 }
@@ -26,34 +29,19 @@ type ICEServer struct {
 	Username       string      `json:"username,omitempty"`
 	Credential     interface{} `json:"credential,omitempty"`
 	CredentialType string      `json:"credentialType,omitempty"`
+	// unix seconds, set if the credentials are short-lived
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
 }
 
 func (peerConnection *PeerConnection) initializeConnection() {
-	config := utils.GetConfig()
-	signalingServer := config.SignalingServer
-
-	//Get ice server config from the signalserver
-	client := resty.New()
-	res, _ := client.R().
-		SetHeader("Accept", "application/json").
-		Get(fmt.Sprintf("%s/ice-config", signalingServer))
-
-	parsed := utils.ParseJson[[]ICEServer](res)
-	iceServers := parsed.Value
-
-	parsedServers := make([]webrtc.ICEServer, len(iceServers))
-	for i, iceServer := range iceServers {
-		parsedServers[i] = webrtc.ICEServer{
-			URLs:           iceServer.URLs,
-			Username:       iceServer.Username,
-			Credential:     iceServer.Credential,
-			CredentialType: webrtc.ICECredentialTypePassword,
-		}
-	}
-	log.Info().Msgf("Got ice servers: %+v", parsedServers)
+	parsedServers := GetIceServers()
 
-	//api := SetupApi()
-	_peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
+	api := SetupApi(func(estimator cc.BandwidthEstimator) {
+		estimator.OnTargetBitrateChange(func(bitrate int) {
+			peerConnection.Emit("estimate", peerConnection.estimate.setTWCC(bitrate))
+		})
+	})
+	_peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
 		ICEServers: parsedServers,
 	})
 
@@ -134,6 +122,7 @@ func newConnection(viewerId string) (peerConnection *PeerConnection) {
 	peerConnection = &PeerConnection{
 		Emitter:  e,
 		ViewerId: viewerId,
+		estimate: &bandwidthEstimate{},
 		Signal: func(signal Signal) error {
 			switch signal.Type {
 			case "offer":
@@ -173,6 +162,13 @@ func newConnection(viewerId string) (peerConnection *PeerConnection) {
 					log.Err(err).Send()
 					return err
 				}
+			case "kick":
+				// the viewer was kicked by the server admin
+				log.Info().
+					Str("viewerId", signal.ViewerId).
+					Msg("viewer kicked, closing connection")
+				peerConnection.Close()
+				peerConnection.Emit("disconnected")
 			}
 			return nil
 		},
@@ -191,18 +187,68 @@ func newConnection(viewerId string) (peerConnection *PeerConnection) {
 				go cb()
 			})
 		},
+		OnBandwidthEstimate: func(cb func(bitrate int)) {
+			e.On("estimate", func(e *emitter.Event) {
+				cb(e.Args[0].(int))
+			})
+		},
 		AddTracks: func(tracks *Tracks) {
 			rtpSender, err := peerConnection.AddTrack(tracks.AudioTrack)
 			if err != nil {
 				panic(err)
 			}
-			processRTCP(rtpSender)
+			processRTCP(peerConnection, rtpSender, nil)
 
-			rtpSender, err = peerConnection.AddTrack(tracks.VideoTrack)
+			var videoTrack webrtc.TrackLocal = tracks.VideoTrack
+			requestKeyframe := tracks.VideoCapture.RequestKeyframe
+			isDirectConnect := utils.GetConfig().IsDirectConnect
+			if tracks.FallbackTrack != nil && isDirectConnect {
+				track := &fallbackTrack{
+					TrackLocal: tracks.VideoTrack,
+					fallback:   tracks.FallbackTrack,
+					onFallback: func() {
+						log.Info().
+							Str("viewerId", peerConnection.ViewerId).
+							Str("codec", tracks.VideoTrack.Codec().MimeType).
+							Msg("the viewer doesn't support the codec, sending the fallback track")
+						tracks.StartFallback()
+					},
+				}
+				videoTrack = track
+				requestKeyframe = func() {
+					if track.useFallback {
+						tracks.FallbackCapture.RequestKeyframe()
+					} else {
+						tracks.VideoCapture.RequestKeyframe()
+					}
+				}
+			}
+			rtpSender, err = peerConnection.AddTrack(videoTrack)
 			if err != nil {
 				panic(err)
 			}
-			processRTCP(rtpSender)
+			processRTCP(peerConnection, rtpSender, requestKeyframe)
+
+			// the server offers a video transceiver for every layer
+			for _, layerTrack := range tracks.LayerTracks {
+				rtpSender, err = peerConnection.AddTrack(layerTrack)
+				if err != nil {
+					panic(err)
+				}
+				rid := strings.TrimPrefix(layerTrack.ID(), "video_")
+				processRTCP(peerConnection, rtpSender, func() {
+					tracks.VideoCapture.RequestLayerKeyframe(rid)
+				})
+			}
+
+			// the server offers a video transceiver for the fallback track too
+			if tracks.FallbackTrack != nil && !isDirectConnect {
+				rtpSender, err = peerConnection.AddTrack(tracks.FallbackTrack)
+				if err != nil {
+					panic(err)
+				}
+				processRTCP(peerConnection, rtpSender, tracks.FallbackCapture.RequestKeyframe)
+			}
 		},
 		PeerConnection: nil,
 	}
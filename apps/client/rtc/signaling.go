@@ -5,6 +5,8 @@ import (
 	"client/utils"
 	"fmt"
 	"image/jpeg"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -26,8 +28,18 @@ type Signaling struct {
 	OnSignal func(cb func(signal Signal))
 }
 type NewStreamBody struct {
-	IsDirectConnect bool `json:"isDirectConnect"`
-	IsPrivate       bool `json:"isPrivate"`
+	IsDirectConnect bool   `json:"isDirectConnect"`
+	IsPrivate       bool   `json:"isPrivate"`
+	IsRemoteEnabled bool   `json:"isRemoteEnabled"`
+	SimulcastLayers int    `json:"simulcastLayers"`
+	HasFallback     bool   `json:"hasFallback"`
+	Owner           string `json:"owner"`
+	ViewerPassword  string `json:"viewerPassword"`
+}
+
+type ViewerTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
 }
 
 type ViewerConnectionEvent struct {
@@ -36,21 +48,81 @@ type ViewerConnectionEvent struct {
 	ViewerCount int    `json:"viewerCount"`
 }
 
-func Initialize() {
+// the server rejects the internal routes with 401 if the stream key is missing or invalid
+func newSignalingClient() *resty.Client {
 	config := utils.GetConfig()
 	client := resty.New()
-	client.R().SetBody(NewStreamBody{
+	if config.StreamKey != "" {
+		client.SetHeader("X-Stream-Key", config.StreamKey)
+	}
+	return client
+}
+
+func Initialize() {
+	config := utils.GetConfig()
+	client := newSignalingClient()
+	// the server keeps the host name of the capture client as the owner of the stream
+	owner, _ := os.Hostname()
+	res, err := client.R().SetBody(NewStreamBody{
 		IsDirectConnect: config.IsDirectConnect,
 		IsPrivate:       config.IsPrivate,
+		IsRemoteEnabled: config.RemoteEnabled,
+		SimulcastLayers: 1 + len(utils.GetSimulcastLayers()),
+		HasFallback:     config.FallbackEncoder != "none",
+		Owner:           owner,
+		ViewerPassword:  config.ViewerPassword,
 	}).
 		Post(fmt.Sprintf("%s/connect/%s/internal", config.SignalingServer, config.StreamId))
 
+	if err != nil {
+		log.Err(err).Msg("Error connecting to signaling server")
+		return
+	}
+	if res.StatusCode() == 401 {
+		log.Error().Str("streamId", config.StreamId).Msg("Signaling server rejected the stream key")
+		return
+	}
+	if res.StatusCode() == 403 {
+		log.Error().Str("streamId", config.StreamId).Msg("Stream is blocked or was terminated by the signaling server")
+		return
+	}
+
 	log.Info().Str("streamId", config.StreamId).Msg("Connected to signaling server")
+
+	if config.IsPrivate {
+		go LogViewerLink()
+	}
+}
+
+// private streams can only be watched with a viewer token or the viewer password,
+// the link includes a token issued by the server
+func LogViewerLink() {
+	config := utils.GetConfig()
+	client := newSignalingClient()
+
+	res, err := client.R().
+		SetHeader("Accept", "application/json").
+		Post(fmt.Sprintf("%s/viewer-token/%s/internal", config.SignalingServer, config.StreamId))
+
+	if err != nil {
+		log.Err(err).Send()
+		return
+	}
+	if res.StatusCode() != 200 {
+		log.Error().Int("status", res.StatusCode()).Msg("Error requesting viewer token")
+		return
+	}
+
+	parsed := utils.ParseJson[ViewerTokenResponse](res)
+	webapp := strings.TrimSuffix(config.SignalingServer, "/api")
+	log.Info().
+		Time("expiresAt", time.Unix(parsed.Value.ExpiresAt, 0)).
+		Msgf("Viewer link: %s/stream/%s?token=%s", webapp, config.StreamId, parsed.Value.Token)
 }
 
 func SendSignals(outgoing_signal_chan chan Signal) {
 	config := utils.GetConfig()
-	client := resty.New()
+	client := newSignalingClient()
 	signals_to_send := make([]Signal, 0)
 	for {
 		select {
@@ -72,7 +144,7 @@ func PollSignals() chan Signal {
 	config := utils.GetConfig()
 	signalsChan := make(chan Signal, 100)
 	go func() {
-		client := resty.New()
+		client := newSignalingClient()
 		for {
 			res, err := client.R().
 				SetHeader("Accept", "application/json").
@@ -89,6 +161,10 @@ func PollSignals() chan Signal {
 				if res.StatusCode() == 404 {
 					Initialize()
 				}
+				if res.StatusCode() == 401 {
+					log.Error().Msg("Signaling server rejected the stream key")
+					time.Sleep(time.Second * 5)
+				}
 				continue
 			}
 			body := utils.ParseJson[[]Signal](res)
@@ -106,7 +182,7 @@ func PollSignals() chan Signal {
 func SendSnapshots() {
 	config := utils.GetConfig()
 	ticker := time.NewTicker(time.Second * 5)
-	client := resty.New()
+	client := newSignalingClient()
 	sx, sy := robotgo.GetScreenSize()
 	for range ticker.C {
 		frame := robotgo.CaptureImg(0, 0, sx, sy)
@@ -131,7 +207,7 @@ func SendSnapshots() {
 func SendViewerConnectionEvent(event ViewerConnectionEvent) {
 	config := utils.GetConfig()
 
-	client := resty.New()
+	client := newSignalingClient()
 
 	_, err := client.R().
 		SetBody(event).
@@ -145,9 +221,9 @@ func SendViewerConnectionEvent(event ViewerConnectionEvent) {
 }
 
 func NewSignaling(cm *ConnectionManager) *Signaling {
+	config := utils.GetConfig()
 	Initialize()
 	outgoing_signal_chan := make(chan Signal, 100)
-	go SendSignals(outgoing_signal_chan)
 	go SendSnapshots()
 	cm.OnConnection(func(connection *PeerConnection) {
 		go SendViewerConnectionEvent(ViewerConnectionEvent{
@@ -165,7 +241,14 @@ func NewSignaling(cm *ConnectionManager) *Signaling {
 		})
 	})
 
-	signalsChan := PollSignals()
+	var signalsChan chan Signal
+	if config.SignalingTransport == "polling" {
+		go SendSignals(outgoing_signal_chan)
+		signalsChan = PollSignals()
+	} else {
+		signalsChan = ConnectSignalingSocket(outgoing_signal_chan)
+	}
+
 	return &Signaling{
 		Signal: func(signal Signal) { outgoing_signal_chan <- signal },
 		OnSignal: func(cb func(signal Signal)) {
@@ -2,15 +2,27 @@ package rtc
 
 import (
 	"client/capture"
+	"client/utils"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/rs/zerolog/log"
+	"github.com/tinyzimmer/go-gst/gst"
 )
 
 type Tracks struct {
 	VideoTrack *webrtc.TrackLocalStaticSample
 	AudioTrack *webrtc.TrackLocalStaticSample
+	// the lower simulcast layers, forwarded by the server
+	LayerTracks []*webrtc.TrackLocalStaticSample
+	// the encoders of the video tracks produce a keyframe on the PLI/FIR of the viewers
+	VideoCapture *capture.ControlledCapture
+	// the H264 video for the viewers not supporting the codec of the encoder, nil without fallback
+	FallbackTrack   *webrtc.TrackLocalStaticSample
+	FallbackCapture *capture.ControlledCapture
+	// StartFallback starts writing the fallback track, a viewer of the direct connection needs it
+	StartFallback func()
 }
 
 type SetupTracksReturnType struct {
@@ -19,11 +31,12 @@ type SetupTracksReturnType struct {
 	Stop   func()
 }
 
-func NewTrackWriter(videoCapture *capture.ControlledCapture, audioCapture *capture.ControlledCapture) SetupTracksReturnType {
+// fallbackCapture is nil if the encoder doesn't need a fallback
+func NewTrackWriter(videoCapture *capture.ControlledCapture, audioCapture *capture.ControlledCapture, fallbackCapture *capture.ControlledCapture) SetupTracksReturnType {
 
 	config := GetRtcConfig()
 
-	videoTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: config.VideoMimeType, ClockRate: 90000}, "video", "pion")
+	videoTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: config.VideoMimeType, ClockRate: 90000, SDPFmtpLine: config.VideoFmtpLine}, "video", "pion")
 	if err != nil {
 		panic(err)
 	}
@@ -33,18 +46,40 @@ func NewTrackWriter(videoCapture *capture.ControlledCapture, audioCapture *captu
 		panic(err)
 	}
 
+	layers := utils.GetSimulcastLayers()
+	layerTracks := make([]*webrtc.TrackLocalStaticSample, len(layers))
+	for i, layer := range layers {
+		// the server reads the layer from the track id
+		layerTracks[i], err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: config.VideoMimeType, ClockRate: 90000, SDPFmtpLine: config.VideoFmtpLine}, "video_"+layer.Rid, "pion")
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var fallbackTrack *webrtc.TrackLocalStaticSample
+	if fallbackCapture != nil {
+		fallbackTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: config.FallbackMimeType, ClockRate: 90000, SDPFmtpLine: config.FallbackFmtpLine}, "video_fallback", "pion")
+		if err != nil {
+			panic(err)
+		}
+	}
+	// the server forwards the fallback track to the viewers needing it, the direct connections start it on demand
+	isDirectConnect := utils.GetConfig().IsDirectConnect
+	fallbackNeeded := !isDirectConnect
+	fallbackSending := false
+
 	stopped := true
 
-	sendVideo := func() {
+	sendVideo := func(track *webrtc.TrackLocalStaticSample, getChannel func() (chan *gst.Buffer, func())) {
 
-		videoSubscription, videoCleanup := videoCapture.GetChannel()
+		videoSubscription, videoCleanup := getChannel()
 		for frame_buffer := range videoSubscription {
 			if stopped {
 				videoCleanup()
 				return
 			}
 
-			err = videoTrack.WriteSample(media.Sample{Data: frame_buffer.Bytes(), Duration: frame_buffer.Duration()})
+			err := track.WriteSample(media.Sample{Data: frame_buffer.Bytes(), Duration: frame_buffer.Duration()})
 			if err != nil {
 				log.Err(err).Send()
 				videoCleanup()
@@ -70,22 +105,47 @@ func NewTrackWriter(videoCapture *capture.ControlledCapture, audioCapture *captu
 		}
 	}
 
+	startFallback := func() {
+		if fallbackTrack == nil || !fallbackNeeded || fallbackSending || stopped {
+			return
+		}
+		fallbackSending = true
+		go sendVideo(fallbackTrack, fallbackCapture.GetChannel)
+	}
+
 	start := func() {
 		if stopped {
 			stopped = false
-			go sendVideo()
+			go sendVideo(videoTrack, videoCapture.GetChannel)
+			startFallback()
+			for i, layer := range layers {
+				rid := layer.Rid
+				go sendVideo(layerTracks[i], func() (chan *gst.Buffer, func()) {
+					return videoCapture.GetLayerChannel(rid)
+				})
+			}
 			go sendAudio()
 		}
 	}
 
 	stop := func() {
 		stopped = true
+		fallbackSending = false
+		fallbackNeeded = !isDirectConnect
 	}
 
 	return SetupTracksReturnType{
 		Tracks: &Tracks{
-			VideoTrack: videoTrack,
-			AudioTrack: audioTrack,
+			VideoTrack:      videoTrack,
+			AudioTrack:      audioTrack,
+			LayerTracks:     layerTracks,
+			VideoCapture:    videoCapture,
+			FallbackTrack:   fallbackTrack,
+			FallbackCapture: fallbackCapture,
+			StartFallback: func() {
+				fallbackNeeded = true
+				startFallback()
+			},
 		},
 		Start: start,
 		Stop:  stop,
@@ -93,14 +153,25 @@ func NewTrackWriter(videoCapture *capture.ControlledCapture, audioCapture *captu
 
 }
 
-func processRTCP(rtpSender *webrtc.RTPSender) {
+// reads the RTCP of the viewer, the interceptors consume the TWCC feedback and the NACKs,
+// requestKeyframe is called on PLI/FIR, nil for the audio track
+func processRTCP(peerConnection *PeerConnection, rtpSender *webrtc.RTPSender, requestKeyframe func()) {
 	go func() {
-		rtcpBuf := make([]byte, 1500)
-
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				return
 			}
+			for _, packet := range packets {
+				switch packet := packet.(type) {
+				case *rtcp.ReceiverEstimatedMaximumBitrate:
+					peerConnection.Emit("estimate", peerConnection.estimate.setREMB(int(packet.Bitrate)))
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					if requestKeyframe != nil {
+						requestKeyframe()
+					}
+				}
+			}
 		}
 	}()
 }
@@ -0,0 +1,126 @@
+package rtc
+
+import (
+	"client/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	socketWriteWait = 10 * time.Second
+	socketReadWait  = 45 * time.Second
+)
+
+func getSignalingSocketUrl() string {
+	config := utils.GetConfig()
+	url := config.SignalingServer
+	if strings.HasPrefix(url, "https://") {
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	} else if strings.HasPrefix(url, "http://") {
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+	return fmt.Sprintf("%s/ws/%s/internal", url, config.StreamId)
+}
+
+// runs until the socket is closed, returns the signals that could not be sent
+func runSignalingSocket(ws *websocket.Conn, outgoing_signal_chan chan Signal, signalsChan chan Signal, pending []Signal) []Signal {
+	closed := make(chan bool)
+
+	ws.SetReadDeadline(time.Now().Add(socketReadWait))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(socketReadWait))
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(socketWriteWait))
+	})
+
+	go func() {
+		defer close(closed)
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				log.Err(err).Msg("Signaling socket closed")
+				return
+			}
+			var signals []Signal
+			if err := json.Unmarshal(msg, &signals); err != nil {
+				log.Err(err).Send()
+				continue
+			}
+			for _, signal := range signals {
+				log.Printf("Received signal from %s", signal.ViewerId)
+				signalsChan <- signal
+			}
+		}
+	}()
+
+	send := func(signals []Signal) bool {
+		ws.SetWriteDeadline(time.Now().Add(socketWriteWait))
+		if err := ws.WriteJSON(signals); err != nil {
+			log.Err(err).Msg("Error sending signals through the signaling socket")
+			return false
+		}
+		return true
+	}
+
+	if len(pending) > 0 {
+		if !send(pending) {
+			ws.Close()
+			<-closed
+			return pending
+		}
+	}
+
+	for {
+		select {
+		case <-closed:
+			ws.Close()
+			return nil
+		case signal := <-outgoing_signal_chan:
+			if !send([]Signal{signal}) {
+				ws.Close()
+				<-closed
+				return []Signal{signal}
+			}
+		}
+	}
+}
+
+// ConnectSignalingSocket keeps a websocket open to the signaling server, reconnecting when it drops.
+// Signals are pushed both ways as soon as they are available.
+func ConnectSignalingSocket(outgoing_signal_chan chan Signal) chan Signal {
+	config := utils.GetConfig()
+	signalsChan := make(chan Signal, 100)
+
+	go func() {
+		header := http.Header{}
+		if config.StreamKey != "" {
+			header.Set("X-Stream-Key", config.StreamKey)
+		}
+		pending := make([]Signal, 0)
+		for {
+			ws, res, err := websocket.DefaultDialer.Dial(getSignalingSocketUrl(), header)
+			if err != nil {
+				log.Error().Err(err).Msg("Error connecting to the signaling socket")
+				time.Sleep(time.Second * 1)
+				if res != nil && res.StatusCode == 404 {
+					Initialize()
+				}
+				if res != nil && res.StatusCode == 401 {
+					log.Error().Msg("Signaling server rejected the stream key")
+					time.Sleep(time.Second * 5)
+				}
+				continue
+			}
+			log.Info().Str("streamId", config.StreamId).Msg("Signaling socket connected")
+			pending = runSignalingSocket(ws, outgoing_signal_chan, signalsChan, pending)
+			time.Sleep(time.Second * 1)
+		}
+	}()
+
+	return signalsChan
+}
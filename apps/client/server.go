@@ -17,7 +17,18 @@ func StartWrtcServer() {
 	videoCapture := capture.NewVideoCapture()
 	audioCapture := capture.NewAudioCapture()
 
-	trackWriter := rtc.NewTrackWriter(videoCapture, audioCapture)
+	// the H264 video for the viewers not supporting the vp9/av1 codec, nil without fallback
+	fallbackCapture := capture.NewFallbackVideoCapture()
+
+	trackWriter := rtc.NewTrackWriter(videoCapture, audioCapture, fallbackCapture)
+
+	// the encoder adapts to the bandwidth of the slowest connection
+	bitrateController := rtc.NewBitrateController(func(bitrate int) {
+		videoCapture.SetBitrate(bitrate)
+		if fallbackCapture != nil {
+			fallbackCapture.SetBitrate(bitrate)
+		}
+	})
 
 	connectionManager.OnFirstConnection(func() {
 		trackWriter.Start()
@@ -32,6 +43,14 @@ func StartWrtcServer() {
 		viewerId := signal.ViewerId
 		connection := connectionManager.GetConnection(viewerId)
 
+		// don't create a connection for a kicked viewer
+		if signal.Type == "kick" {
+			if connection != nil {
+				connection.Signal(signal)
+			}
+			return
+		}
+
 		if connection == nil {
 
 			connection = connectionManager.NewConnection(viewerId)
@@ -46,8 +65,13 @@ func StartWrtcServer() {
 				log.Info().Str("viewerId", viewerId).Msg("Connected")
 			})
 
+			connection.OnBandwidthEstimate(func(bitrate int) {
+				bitrateController.Update(viewerId, bitrate)
+			})
+
 			connection.OnDisconnected(func() {
 				log.Info().Str("viewerId", viewerId).Msg("Disconnected")
+				bitrateController.Remove(viewerId)
 			})
 
 			go remote.SetupRemote(connection)
@@ -16,14 +16,31 @@ import (
 {
   "settings": {
     "stream_id": "default",
+    "stream_key": "",
+    "viewer_password": "",
     "remote_enabled": false,
     "direct_connect": true,
     "bitrate": 15388600,
+    "min_bitrate": 1538860,
+    "max_bitrate": 15388600,
     "resolution": "1920x1080",
     "framerate": 90,
     "encoder": "nvenc",
     "threads": 4,
-    "server_url": "http://localhost:4000/api"
+    "server_url": "http://localhost:4000/api",
+    "signaling_transport": "websocket",
+    "simulcast": false,
+    "source": "screen",
+    "x264_speed_preset": "superfast",
+    "x264_profile": "high",
+    "x264_intra_refresh": false,
+    "fallback_encoder": "h264",
+    "video_pipeline": "",
+    "audio_pipeline": "",
+    "pipeline_overrides": {
+      "nvh264enc": { "preset": "4" },
+      "opusenc": { "bitrate": "96000" }
+    }
   }
 }
 
@@ -69,16 +86,31 @@ func loadConfigFromFile() ConfigFile {
 	}
 	defaultConfig := ConfigFile{
 		Settigs: ConfigFileSettings{
-			StreamId:        "default",
-			RemoteEnabled:   false,
-			IsDirectConnect: true,
-			IsPrivate:       false,
-			Bitrate:         15388600,
-			Resolution:      "1920x1080",
-			Framerate:       60,
-			Encoder:         "nvenc",
-			Threads:         4,
-			SignalingServer: "https://stream.0.tunnelr.co/api",
+			StreamId:           "default",
+			StreamKey:          "",
+			ViewerPassword:     "",
+			RemoteEnabled:      false,
+			IsDirectConnect:    true,
+			IsPrivate:          false,
+			Bitrate:            15388600,
+			MinBitrate:         1538860,
+			MaxBitrate:         15388600,
+			Resolution:         "1920x1080",
+			Framerate:          60,
+			Encoder:            "nvenc",
+			Threads:            4,
+			SignalingServer:    "https://stream.0.tunnelr.co/api",
+			SignalingTransport: "websocket",
+			Simulcast:          false,
+			Source:             "screen",
+			X264SpeedPreset:    "superfast",
+			X264Profile:        "high",
+			X264IntraRefresh:   false,
+			FallbackEncoder:    "h264",
+
+			CustomVideoPipeline: "",
+			CustomAudioPipeline: "",
+			PipelineOverrides:   map[string]map[string]string{},
 		},
 	}
 	json, err := json.MarshalIndent(defaultConfig, "", "  ")
@@ -102,42 +134,87 @@ func loadConfigFromFile() ConfigFile {
 }
 
 type ConfigFileSettings struct {
-	StreamId        string `json:"stream_id"`
-	RemoteEnabled   bool   `json:"remote_enabled"`
-	IsDirectConnect bool   `json:"direct_connect"`
-	IsPrivate       bool   `json:"private"`
-	Bitrate         int    `json:"bitrate"`
-	Resolution      string `json:"resolution"`
-	Framerate       int    `json:"framerate"`
-	Encoder         string `json:"encoder"`
-	Threads         int    `json:"threads"`
-	SignalingServer string `json:"server_url"`
+	StreamId           string `json:"stream_id"`
+	StreamKey          string `json:"stream_key"`
+	ViewerPassword     string `json:"viewer_password"`
+	RemoteEnabled      bool   `json:"remote_enabled"`
+	IsDirectConnect    bool   `json:"direct_connect"`
+	IsPrivate          bool   `json:"private"`
+	Bitrate            int    `json:"bitrate"`
+	MinBitrate         int    `json:"min_bitrate"`
+	MaxBitrate         int    `json:"max_bitrate"`
+	Resolution         string `json:"resolution"`
+	Framerate          int    `json:"framerate"`
+	Encoder            string `json:"encoder"`
+	Threads            int    `json:"threads"`
+	SignalingServer    string `json:"server_url"`
+	SignalingTransport string `json:"signaling_transport"`
+	Simulcast          bool   `json:"simulcast"`
+	Source             string `json:"source"`
+	X264SpeedPreset    string `json:"x264_speed_preset"`
+	X264Profile        string `json:"x264_profile"`
+	X264IntraRefresh   bool   `json:"x264_intra_refresh"`
+	FallbackEncoder    string `json:"fallback_encoder"`
+	// replace the generated pipelines, they need an appsink named appsink
+	CustomVideoPipeline string `json:"video_pipeline"`
+	CustomAudioPipeline string `json:"audio_pipeline"`
+	// element factory or name -> property -> value, merged into the generated pipelines
+	PipelineOverrides map[string]map[string]string `json:"pipeline_overrides"`
 }
 type ConfigFile struct {
 	Settigs ConfigFileSettings `json:"settings"`
 }
 
 type Config struct {
-	RemoteEnabled   bool
-	IsDirectConnect bool
-	IsPrivate       bool
-	SignalingServer string
-	StreamId        string
-	Bitrate         int
-	Resolution      string
-	ResolutionX     int
-	ResolutionY     int
-	Framerate       int
-	Threads         int
-	Encoder         string
+	RemoteEnabled      bool
+	IsDirectConnect    bool
+	IsPrivate          bool
+	SignalingServer    string
+	SignalingTransport string
+	StreamId           string
+	StreamKey          string
+	ViewerPassword     string
+	Bitrate            int
+	MinBitrate         int
+	MaxBitrate         int
+	Resolution         string
+	ResolutionX        int
+	ResolutionY        int
+	Framerate          int
+	Threads            int
+	Encoder            string
+	AV1Encoder         string
+	Simulcast          bool
+	Source             string
+	X264SpeedPreset    string
+	X264Profile        string
+	X264IntraRefresh   bool
+	FallbackEncoder    string
+
+	// the pipelines of the config file, empty to generate them
+	CustomVideoPipeline string
+	CustomAudioPipeline string
+	PipelineOverrides   map[string]map[string]string
+}
+
+// the speed presets of x264enc, fastest first
+var x264SpeedPresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+// H264ProfileLevelIds are the profile-level-ids of the H264 profiles negotiated with the viewers, level 3.1
+var H264ProfileLevelIds = map[string]string{
+	"baseline": "42e01f",
+	"main":     "4d001f",
+	"high":     "640c1f",
 }
 
 type MediaConfig struct {
 	Config
 	VideoPipeline string
-	AudioPipeline string
-	VideoMimeType string
-	AudioMimeType string
+	// the H264 video for the viewers not supporting the codec of the encoder, empty without fallback
+	FallbackVideoPipeline string
+	AudioPipeline         string
+	VideoMimeType         string
+	AudioMimeType         string
 }
 
 var config *Config
@@ -160,19 +237,119 @@ func initConfig() {
 		log.Fatal().Msgf("Invalid resolution specified: %s", settings.Resolution)
 	}
 
+	if settings.SignalingTransport == "" {
+		settings.SignalingTransport = "websocket"
+	}
+	if settings.SignalingTransport != "websocket" && settings.SignalingTransport != "polling" {
+		log.Fatal().Msgf("Invalid signaling transport specified: %s", settings.SignalingTransport)
+	}
+	if settings.Source == "" {
+		settings.Source = "screen"
+	}
+	if settings.Source != "screen" && settings.Source != "test" {
+		log.Fatal().Msgf("Invalid source specified: %s", settings.Source)
+	}
+	if settings.X264SpeedPreset == "" {
+		settings.X264SpeedPreset = "superfast"
+	}
+	if settings.X264Profile == "" {
+		settings.X264Profile = "high"
+	}
+	if settings.FallbackEncoder == "" {
+		settings.FallbackEncoder = "h264"
+	}
+	if settings.FallbackEncoder != "h264" && settings.FallbackEncoder != "x264" && settings.FallbackEncoder != "nvenc" && settings.FallbackEncoder != "none" {
+		log.Fatal().Msgf("Invalid fallback encoder specified: %s", settings.FallbackEncoder)
+	}
+	// every viewer supports VP8 and H264, only VP9 and AV1 need the fallback
+	if settings.Encoder != "vp9" && settings.Encoder != "av1" {
+		settings.FallbackEncoder = "none"
+	}
+	if settings.Encoder == "x264" || settings.FallbackEncoder == "x264" {
+		validPreset := false
+		for _, preset := range x264SpeedPresets {
+			validPreset = validPreset || preset == settings.X264SpeedPreset
+		}
+		if !validPreset {
+			log.Fatal().Msgf("Invalid x264 speed preset specified: %s", settings.X264SpeedPreset)
+		}
+		if _, ok := H264ProfileLevelIds[settings.X264Profile]; !ok {
+			log.Fatal().Msgf("Invalid x264 profile specified: %s", settings.X264Profile)
+		}
+	}
+	av1Encoder := ""
+	if settings.Encoder == "av1" {
+		av1Encoder, err = findAV1Encoder()
+		if err != nil {
+			log.Fatal().Msgf("Invalid encoder specified: %s", err)
+		}
+	}
+	if settings.MaxBitrate == 0 {
+		settings.MaxBitrate = settings.Bitrate
+	}
+	if settings.MinBitrate == 0 {
+		settings.MinBitrate = settings.Bitrate / 10
+	}
+	if settings.MinBitrate > settings.MaxBitrate {
+		log.Fatal().Msgf("Invalid bitrate bounds specified: min_bitrate %d is higher than max_bitrate %d", settings.MinBitrate, settings.MaxBitrate)
+	}
+	if settings.Bitrate < settings.MinBitrate {
+		log.Warn().Msg("The bitrate is lower than min_bitrate, using min_bitrate")
+		settings.Bitrate = settings.MinBitrate
+	}
+	if settings.Bitrate > settings.MaxBitrate {
+		log.Warn().Msg("The bitrate is higher than max_bitrate, using max_bitrate")
+		settings.Bitrate = settings.MaxBitrate
+	}
+	if settings.Simulcast && settings.Encoder != "nvenc" {
+		log.Warn().Msg("Simulcast is only supported by the nvenc encoder, disabling it")
+		settings.Simulcast = false
+	}
+	if settings.Simulcast && settings.CustomVideoPipeline != "" {
+		log.Warn().Msg("Simulcast is not supported with a custom video pipeline, disabling it")
+		settings.Simulcast = false
+	}
+	// the overrides are inserted into the pipeline description, they can't add elements or properties
+	for element, properties := range settings.PipelineOverrides {
+		for property, value := range properties {
+			if element == "" || property == "" || strings.ContainsAny(element+property, " =!") {
+				log.Fatal().Msgf("Invalid pipeline override specified: %s %s", element, property)
+			}
+			if value == "" || strings.ContainsAny(value, " \t\n\r!\"'") {
+				log.Fatal().Msgf("Invalid pipeline override value specified: %s %s=%s", element, property, value)
+			}
+		}
+	}
+
 	config = &Config{
-		RemoteEnabled:   settings.RemoteEnabled,
-		IsDirectConnect: settings.IsDirectConnect,
-		IsPrivate:       settings.IsPrivate,
-		SignalingServer: settings.SignalingServer,
-		StreamId:        settings.StreamId,
-		Bitrate:         settings.Bitrate,
-		Resolution:      settings.Resolution,
-		ResolutionX:     resolutionX,
-		ResolutionY:     resolutionY,
-		Framerate:       settings.Framerate,
-		Threads:         settings.Threads,
-		Encoder:         settings.Encoder,
+		RemoteEnabled:      settings.RemoteEnabled,
+		IsDirectConnect:    settings.IsDirectConnect,
+		IsPrivate:          settings.IsPrivate,
+		SignalingServer:    settings.SignalingServer,
+		SignalingTransport: settings.SignalingTransport,
+		StreamId:           settings.StreamId,
+		StreamKey:          settings.StreamKey,
+		ViewerPassword:     settings.ViewerPassword,
+		Bitrate:            settings.Bitrate,
+		MinBitrate:         settings.MinBitrate,
+		MaxBitrate:         settings.MaxBitrate,
+		Resolution:         settings.Resolution,
+		ResolutionX:        resolutionX,
+		ResolutionY:        resolutionY,
+		Framerate:          settings.Framerate,
+		Threads:            settings.Threads,
+		Encoder:            settings.Encoder,
+		AV1Encoder:         av1Encoder,
+		Simulcast:          settings.Simulcast,
+		Source:             settings.Source,
+		X264SpeedPreset:    settings.X264SpeedPreset,
+		X264Profile:        settings.X264Profile,
+		X264IntraRefresh:   settings.X264IntraRefresh,
+		FallbackEncoder:    settings.FallbackEncoder,
+
+		CustomVideoPipeline: settings.CustomVideoPipeline,
+		CustomAudioPipeline: settings.CustomAudioPipeline,
+		PipelineOverrides:   settings.PipelineOverrides,
 	}
 
 }
@@ -184,34 +361,95 @@ func GetConfig() Config {
 	return *config
 }
 
-func GetMediaConfig() MediaConfig {
+type SimulcastLayer struct {
+	// the suffix of the video track id and the appsink name
+	Rid string
+	// the resolution is divided by it, the bitrate by its square
+	Scale int
+}
 
+// GetSimulcastLayers returns the lower layers published besides the full resolution video,
+// the server forwarding the stream selects one of them for every viewer
+func GetSimulcastLayers() []SimulcastLayer {
 	config := GetConfig()
-	var videoPipeline string
-	var videoMimeType string
+	if !config.Simulcast || config.IsDirectConnect {
+		return []SimulcastLayer{}
+	}
+	return []SimulcastLayer{
+		{Rid: "h", Scale: 2},
+		{Rid: "q", Scale: 4},
+	}
+}
+
+// SimulcastBitrateShare returns the bitrate of all the layers relative to the full resolution layer
+func SimulcastBitrateShare() float64 {
+	share := 1.0
+	for _, layer := range GetSimulcastLayers() {
+		share += 1 / float64(layer.Scale*layer.Scale)
+	}
+	return share
+}
+
+// the mime types of the encoders' output, a custom video pipeline produces the one of the encoder too
+var encoderMimeTypes = map[string]string{
+	"vp8":   webrtc.MimeTypeVP8,
+	"vp9":   webrtc.MimeTypeVP9,
+	"av1":   webrtc.MimeTypeAV1,
+	"h264":  webrtc.MimeTypeH264,
+	"nvenc": webrtc.MimeTypeH264,
+	"x264":  webrtc.MimeTypeH264,
+}
 
-	switch config.Encoder {
+// returns the generated video pipeline of the encoder
+func encoderPipeline(encoder string) string {
+	switch encoder {
 	case "vp8":
-		videoPipeline = WinVP8Pipeline()
-		videoMimeType = webrtc.MimeTypeVP8
+		return VP8Pipeline(videoSource())
+	case "vp9":
+		return VP9Pipeline(videoSource())
+	case "av1":
+		return AV1Pipeline(videoSource())
 	case "h264":
-		videoPipeline = WinOpenH264Pipeline()
-		videoMimeType = webrtc.MimeTypeH264
+		return OpenH264Pipeline(videoSource())
 	case "nvenc":
-		videoPipeline = WinNvH264Pipeline()
-		videoMimeType = webrtc.MimeTypeH264
-	default:
+		return NvH264Pipeline(videoSource())
+	case "x264":
+		return X264Pipeline(videoSource())
+	}
+	log.Fatal().Msg("Invalid encoder specified")
+	return ""
+}
+
+func GetMediaConfig() MediaConfig {
+
+	config := GetConfig()
+	videoMimeType, ok := encoderMimeTypes[config.Encoder]
+	if !ok {
 		log.Fatal().Msg("Invalid encoder specified")
 	}
+	videoPipeline := config.CustomVideoPipeline
+	if videoPipeline == "" {
+		videoPipeline = encoderPipeline(config.Encoder)
+	}
 
-	audioPipeline := WinOpusPipeline()
+	// the fallback encoder captures the source separately
+	fallbackVideoPipeline := ""
+	if config.FallbackEncoder != "none" {
+		fallbackVideoPipeline = encoderPipeline(config.FallbackEncoder)
+	}
+
+	audioPipeline := config.CustomAudioPipeline
+	if audioPipeline == "" {
+		audioPipeline = OpusPipeline(audioSource())
+	}
 	audioMimeType := webrtc.MimeTypeOpus
 
 	return MediaConfig{
-		Config:        config,
-		VideoPipeline: videoPipeline,
-		AudioPipeline: audioPipeline,
-		VideoMimeType: videoMimeType,
-		AudioMimeType: audioMimeType,
+		Config:                config,
+		VideoPipeline:         videoPipeline,
+		FallbackVideoPipeline: fallbackVideoPipeline,
+		AudioPipeline:         audioPipeline,
+		VideoMimeType:         videoMimeType,
+		AudioMimeType:         audioMimeType,
 	}
 }
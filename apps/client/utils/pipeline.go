@@ -2,19 +2,91 @@ package utils
 
 import (
 	"fmt"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/tinyzimmer/go-gst/gst"
 )
 
-func WinVP8Pipeline() string {
-	config := GetConfig()
-	framerate := config.Framerate
-	width := config.ResolutionX
-	height := config.ResolutionY
-	bitrate := config.Bitrate
-	threads := config.Threads
+// the AV1 encoders, the first installed one is used: SVT-AV1, rav1e, libaom
+var av1Encoders = []string{"svtav1enc", "rav1enc", "av1enc"}
+
+// buildPipeline merges the pipeline_overrides of the config into the elements and joins the pipeline,
+// the overrides of an element factory (nvh264enc) apply to all its elements, the ones of a name (encoder_h) take precedence
+func buildPipeline(pipelinearr []string) string {
+	overrides := GetConfig().PipelineOverrides
+	if len(overrides) == 0 {
+		return strings.Join(pipelinearr, " ")
+	}
 
-	pipelinearr_vp8 := []string{
+	merged := make([]string, 0, len(pipelinearr))
+	element := []string{}
+	for _, token := range pipelinearr {
+		if token == "!" {
+			merged = append(merged, overrideProperties(element, overrides)...)
+			merged = append(merged, token)
+			element = []string{}
+			continue
+		}
+		element = append(element, token)
+	}
+	merged = append(merged, overrideProperties(element, overrides)...)
+	return strings.Join(merged, " ")
+}
+
+// replaces the properties of the element, the ones it doesn't set are added after its last property
+func overrideProperties(element []string, overrides map[string]map[string]string) []string {
+	if len(element) == 0 {
+		return element
+	}
+	properties := map[string]string{}
+	for property, value := range overrides[element[0]] {
+		properties[property] = value
+	}
+	for _, token := range element[1:] {
+		if strings.HasPrefix(token, "name=") {
+			for property, value := range overrides[strings.TrimPrefix(token, "name=")] {
+				properties[property] = value
+			}
+		}
+	}
+	if len(properties) == 0 {
+		return element
+	}
+
+	result := []string{element[0]}
+	end := 1
+	for i, token := range element[1:] {
+		if !strings.Contains(token, "=") {
+			result = append(result, element[1+i:]...)
+			break
+		}
+		property := strings.SplitN(token, "=", 2)[0]
+		if value, ok := properties[property]; ok {
+			token = property + "=" + value
+			delete(properties, property)
+		}
+		result = append(result, token)
+		end++
+	}
+
+	// the order of the config is lost by the map, the added properties are sorted
+	added := make([]string, 0, len(properties))
+	for property := range properties {
+		added = append(added, property)
+	}
+	sort.Strings(added)
+	for i, property := range added {
+		added[i] = property + "=" + properties[property]
+	}
+	return append(result[:end], append(added, result[end:]...)...)
+}
+
+// the desktop capture of windows, downloaded to system memory for the encoders
+func winScreenSource() []string {
+	return []string{
 		"d3d11screencapturesrc",
 		"monitor-index=0",
 		//"show-cursor=1",
@@ -25,24 +97,90 @@ func WinVP8Pipeline() string {
 
 		"d3d11download",
 		"!",
+	}
+}
+
+// the desktop capture of linux, the X11 display is taken from DISPLAY (Xvfb works too)
+func linuxScreenSource(framerate int) []string {
+	return []string{
+		"ximagesrc",
+		"use-damage=false",
+		"show-pointer=true",
+		"!",
+
+		fmt.Sprintf("video/x-raw,framerate=%d/1", framerate),
+		"!",
+
+		"videoconvert",
+		"!",
+
+		// the screen is scaled to the configured resolution
+		"videoscale",
+		"!",
+	}
+}
+
+// the moving test pattern with the running time burned in, for developing and testing without a desktop
+func testVideoSource(framerate int, width int, height int) []string {
+	return []string{
+		"videotestsrc",
+		"is-live=true",
+		"pattern=ball",
+		"!",
+
+		fmt.Sprintf("video/x-raw,framerate=%d/1,width=%d,height=%d", framerate, width, height),
+		"!",
+
+		"timeoverlay",
+		"halignment=center",
+		"valignment=center",
+		"font-desc=\"Sans 48\"",
+		"!",
+
+		"videoconvert",
+		"!",
+	}
+}
 
+// the capture elements of the configured source, linux captures the X11 display, the other systems use the windows capture
+func videoSource() []string {
+	config := GetConfig()
+	switch {
+	case config.Source == "test":
+		return testVideoSource(config.Framerate, config.ResolutionX, config.ResolutionY)
+	case runtime.GOOS == "linux":
+		return linuxScreenSource(config.Framerate)
+	}
+	return winScreenSource()
+}
+
+func VP8Pipeline(source []string) string {
+	config := GetConfig()
+	framerate := config.Framerate
+	width := config.ResolutionX
+	height := config.ResolutionY
+	bitrate := config.Bitrate
+	threads := config.Threads
+
+	pipelinearr_vp8 := append(source,
 		//fmt.Sprintf("video/x-raw,framerate=%s/1", framerate),
 		//"!",
 
 		"queue2",
 		"max-size-buffers=0",
 		"max-size-bytes=0",
-		"max-size-time=" + strconv.Itoa((1000000000/framerate)*2),
+		"max-size-time="+strconv.Itoa((1000000000/framerate)*2),
 		"!",
 
 		//Optimize for framerate
 		"vp8enc",
-		"threads=" + strconv.Itoa(threads),
+		"name=encoder",
+		"threads="+strconv.Itoa(threads),
 		"deadline=1",
 		"max-quantizer=40",
 		"min-quantizer=4",
-		"max-intra-bitrate=" + strconv.Itoa(bitrate),
-		"target-bitrate=" + strconv.Itoa(bitrate),
+		"max-intra-bitrate="+strconv.Itoa(bitrate),
+		"target-bitrate="+strconv.Itoa(bitrate),
 		"!",
 
 		fmt.Sprintf("video/x-vp8,framerate=%d/1,width=%d,height=%d", framerate, width, height),
@@ -50,46 +188,155 @@ func WinVP8Pipeline() string {
 
 		"appsink",
 		"name=appsink",
+	)
+	return buildPipeline(pipelinearr_vp8)
+}
+
+func VP9Pipeline(source []string) string {
+	config := GetConfig()
+	framerate := config.Framerate
+	width := config.ResolutionX
+	height := config.ResolutionY
+	bitrate := config.Bitrate
+	threads := config.Threads
+
+	pipelinearr_vp9 := append(source,
+		"queue2",
+		"max-size-buffers=0",
+		"max-size-bytes=0",
+		"max-size-time="+strconv.Itoa((1000000000/framerate)*2),
+		"!",
+
+		//Optimize for framerate
+		"vp9enc",
+		"name=encoder",
+		"threads="+strconv.Itoa(threads),
+		"row-mt=true",
+		"deadline=1",
+		"cpu-used=8",
+		"max-quantizer=40",
+		"min-quantizer=4",
+		"target-bitrate="+strconv.Itoa(bitrate),
+		"!",
+
+		fmt.Sprintf("video/x-vp9,framerate=%d/1,width=%d,height=%d", framerate, width, height),
+		"!",
+
+		"appsink",
+		"name=appsink",
+	)
+	return buildPipeline(pipelinearr_vp9)
+}
+
+// returns the first installed AV1 encoder
+func findAV1Encoder() (string, error) {
+	// the registry of the plugins is loaded by the initialization, it can be called more than once
+	gst.Init(nil)
+	for _, encoder := range av1Encoders {
+		if gst.Find(encoder) != nil {
+			return encoder, nil
+		}
 	}
-	return strings.Join(pipelinearr_vp8, " ")
+	return "", fmt.Errorf("no AV1 encoder found, install one of: %s", strings.Join(av1Encoders, ", "))
 }
 
-func WinOpenH264Pipeline() string {
+// the realtime settings of the AV1 encoders
+func av1EncoderProperties(encoder string, framerate int, bitrate int, threads int) []string {
+	switch encoder {
+	case "svtav1enc":
+		return []string{
+			"preset=12",
+			"intra-period-length=" + strconv.Itoa(framerate*2),
+			//Convert bitrate from bits to kbits
+			"target-bitrate=" + strconv.Itoa(bitrate/1024),
+		}
+	case "rav1enc":
+		return []string{
+			"speed-preset=10",
+			"low-latency=true",
+			"threads=" + strconv.Itoa(threads),
+			"max-key-frame-interval=" + strconv.Itoa(framerate*2),
+			"bitrate=" + strconv.Itoa(bitrate),
+		}
+	}
+	return []string{
+		"usage-profile=realtime",
+		"cpu-used=8",
+		"end-usage=cbr",
+		"lag-in-frames=0",
+		"row-mt=true",
+		"threads=" + strconv.Itoa(threads),
+		"keyframe-max-dist=" + strconv.Itoa(framerate*2),
+		//Convert bitrate from bits to kbits
+		"target-bitrate=" + strconv.Itoa(bitrate/1024),
+	}
+}
+
+func AV1Pipeline(source []string) string {
 	config := GetConfig()
 	framerate := config.Framerate
 	width := config.ResolutionX
 	height := config.ResolutionY
 	bitrate := config.Bitrate
 	threads := config.Threads
+	encoder := config.AV1Encoder
 
-	pipelinearr_openh264 := []string{
-		"d3d11screencapturesrc",
-		"monitor-index=0",
-		//"show-cursor=1",
+	pipelinearr_av1 := append(source,
+		fmt.Sprintf("video/x-raw,framerate=%d/1,width=%d,height=%d", framerate, width, height),
 		"!",
 
-		"d3d11convert",
+		"queue2",
+		"max-size-buffers=0",
+		"max-size-bytes=0",
+		"max-size-time="+strconv.Itoa((1000000000/framerate)*2),
 		"!",
 
-		"d3d11download",
+		encoder,
+		"name=encoder",
+	)
+	pipelinearr_av1 = append(pipelinearr_av1, av1EncoderProperties(encoder, framerate, bitrate, threads)...)
+	pipelinearr_av1 = append(pipelinearr_av1,
 		"!",
 
+		// a temporal unit of OBUs with size fields per sample, the payloader packetizes them
+		"av1parse",
+		"!",
+
+		"video/x-av1,stream-format=obu-stream,alignment=tu",
+		"!",
+
+		"appsink",
+		"name=appsink",
+	)
+	return buildPipeline(pipelinearr_av1)
+}
+
+func OpenH264Pipeline(source []string) string {
+	config := GetConfig()
+	framerate := config.Framerate
+	width := config.ResolutionX
+	height := config.ResolutionY
+	bitrate := config.Bitrate
+	threads := config.Threads
+
+	pipelinearr_openh264 := append(source,
 		fmt.Sprintf("video/x-raw,framerate=%d/1,width=%d,height=%d", framerate, width, height),
 		"!",
 
 		"queue2",
 		"max-size-buffers=0",
 		"max-size-bytes=0",
-		"max-size-time=" + strconv.Itoa((1000000000/framerate)*2),
+		"max-size-time="+strconv.Itoa((1000000000/framerate)*2),
 		"!",
 
 		//Optimize for framerate
 		"openh264enc",
+		"name=encoder",
 		"enable-frame-skip=true",
 		"deblocking=1",
-		"bitrate=" + strconv.Itoa(bitrate),
+		"bitrate="+strconv.Itoa(bitrate),
 		"complexity=0",
-		"multi-thread=" + strconv.Itoa(threads),
+		"multi-thread="+strconv.Itoa(threads),
 		"qp-max=40",
 		"slice-mode=5",
 		"!",
@@ -99,33 +346,57 @@ func WinOpenH264Pipeline() string {
 
 		"appsink",
 		"name=appsink",
-	}
-	return strings.Join(pipelinearr_openh264, " ")
+	)
+	return buildPipeline(pipelinearr_openh264)
 }
 
-func WinNvH264Pipeline() string {
-
+func X264Pipeline(source []string) string {
 	config := GetConfig()
 	framerate := config.Framerate
 	width := config.ResolutionX
 	height := config.ResolutionY
 	bitrate := config.Bitrate
+	threads := config.Threads
 
-	pipelinearr_nvenc := []string{
-		"d3d11screencapturesrc",
-		"monitor-index=0",
-		//"show-cursor=1",
+	pipelinearr_x264 := append(source,
+		fmt.Sprintf("video/x-raw,framerate=%d/1,width=%d,height=%d", framerate, width, height),
 		"!",
 
-		"d3d11convert",
+		"queue2",
+		"max-size-buffers=0",
+		"max-size-bytes=0",
+		"max-size-time="+strconv.Itoa((1000000000/framerate)*2),
 		"!",
 
-		"d3d11download",
+		//Optimize for latency, no lookahead and b-frames
+		"x264enc",
+		"name=encoder",
+		"tune=zerolatency",
+		"speed-preset="+config.X264SpeedPreset,
+		"threads="+strconv.Itoa(threads),
+		// the intra refresh spreads the keyframes over multiple frames, instead of a periodic bitrate spike
+		"intra-refresh="+strconv.FormatBool(config.X264IntraRefresh),
+		"key-int-max="+strconv.Itoa(framerate*2),
+		//Convert bitrate from bits to kbits
+		"bitrate="+strconv.Itoa(bitrate/1024),
 		"!",
 
-		fmt.Sprintf("video/x-raw,format=NV12,framerate=%d/1,width=%d,height=%d", framerate, width, height),
+		"video/x-h264,profile="+config.X264Profile,
+		"!",
+
+		"h264parse",
+		"config-interval=-1",
 		"!",
 
+		"appsink",
+		"name=appsink",
+	)
+	return buildPipeline(pipelinearr_x264)
+}
+
+// the encoder branch of a simulcast layer, after the tee of NvH264Pipeline
+func nvH264Branch(framerate int, bitrate int, encoderName string, sinkName string) []string {
+	return []string{
 		"queue2",
 		"max-size-buffers=0",
 		"max-size-bytes=0",
@@ -134,6 +405,7 @@ func WinNvH264Pipeline() string {
 
 		//Optimize for framerate
 		"nvh264enc",
+		"name=" + encoderName,
 		"preset=5",
 		"rc-mode=5",
 		"zerolatency=true",
@@ -147,17 +419,94 @@ func WinNvH264Pipeline() string {
 		"!",
 
 		"appsink",
-		"name=appsink",
+		"name=" + sinkName,
 	}
-	return strings.Join(pipelinearr_nvenc, " ")
 }
 
-func WinOpusPipeline() string {
-	pipelinearr := []string{
+func NvH264Pipeline(source []string) string {
+
+	config := GetConfig()
+	framerate := config.Framerate
+	width := config.ResolutionX
+	height := config.ResolutionY
+	bitrate := config.Bitrate
+
+	pipelinearr_nvenc := append(source,
+		fmt.Sprintf("video/x-raw,format=NV12,framerate=%d/1,width=%d,height=%d", framerate, width, height),
+		"!",
+	)
+
+	layers := GetSimulcastLayers()
+	if len(layers) == 0 {
+		pipelinearr_nvenc = append(pipelinearr_nvenc, nvH264Branch(framerate, bitrate, "encoder", "appsink")...)
+		return buildPipeline(pipelinearr_nvenc)
+	}
+
+	// every simulcast layer has its own encoder, the lower layers are scaled down
+	pipelinearr_nvenc = append(pipelinearr_nvenc, "tee", "name=t", "t.", "!")
+	pipelinearr_nvenc = append(pipelinearr_nvenc, nvH264Branch(framerate, bitrate, "encoder", "appsink")...)
+	for _, layer := range layers {
+		pipelinearr_nvenc = append(pipelinearr_nvenc,
+			"t.",
+			"!",
+			"videoscale",
+			"!",
+			// the encoder needs even dimensions
+			fmt.Sprintf("video/x-raw,width=%d,height=%d", (width/layer.Scale)&^1, (height/layer.Scale)&^1),
+			"!",
+		)
+		pipelinearr_nvenc = append(pipelinearr_nvenc, nvH264Branch(framerate, bitrate/(layer.Scale*layer.Scale), "encoder_"+layer.Rid, "appsink_"+layer.Rid)...)
+	}
+	return buildPipeline(pipelinearr_nvenc)
+}
+
+// EncoderBitrate returns the bitrate property of the encoder element (by its factory name),
+// and its value for the bitrate in bits per second
+func EncoderBitrate(factory string, bitrate int) (string, interface{}) {
+	switch factory {
+	case "vp8enc", "vp9enc":
+		return "target-bitrate", bitrate
+	case "openh264enc":
+		return "bitrate", uint(bitrate)
+	case "rav1enc":
+		return "bitrate", bitrate
+	case "svtav1enc", "av1enc":
+		//Convert bitrate from bits to kbits
+		return "target-bitrate", uint(bitrate / 1024)
+	}
+	//Convert bitrate from bits to kbits, nvenc and x264
+	return "bitrate", uint(bitrate / 1024)
+}
+
+// the sound played by the desktop, on linux the monitor of the default output
+func audioSource() []string {
+	if GetConfig().Source == "test" {
+		return []string{
+			"audiotestsrc",
+			"is-live=true",
+			"wave=sine",
+			"freq=440",
+			"volume=0.1",
+			"!",
+		}
+	}
+	if runtime.GOOS == "linux" {
+		return []string{
+			"pulsesrc",
+			"device=@DEFAULT_MONITOR@",
+			"!",
+		}
+	}
+	return []string{
 		"wasapisrc",
 		"low-latency=true",
 		"loopback=true",
 		"!",
+	}
+}
+
+func OpusPipeline(source []string) string {
+	pipelinearr := append(source,
 		"audioconvert",
 		"!",
 		"queue2",
@@ -169,7 +518,7 @@ func WinOpusPipeline() string {
 		"!",
 		"appsink",
 		"name=appsink",
-	}
+	)
 
-	return strings.Join(pipelinearr, " ")
+	return buildPipeline(pipelinearr)
 }
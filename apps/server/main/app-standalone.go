@@ -4,8 +4,13 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"signaling/main/auth"
+	"signaling/main/config"
+	"signaling/main/metrics"
 	"signaling/main/stream"
+	"strings"
 
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/joho/godotenv"
@@ -23,12 +28,50 @@ func createMux() *echo.Echo {
 	return e
 }
 
+// the argument is either a YAML config file or an env file, the env file is used by the packaged executables
+func loadConfig(path string) *config.Config {
+	configPath := os.Getenv("CONFIG_FILE")
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		configPath = path
+	} else if path != "" {
+		godotenv.Load(path)
+	}
+
+	serverConfig, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return serverConfig
+}
+
+// prints the stream key for a stream id, to be set in the capture client's config.json
+// usage: server keygen <streamId> [configPath]
+func keygen(args []string) {
+	configPath := ""
+	if len(args) > 1 {
+		configPath = args[1]
+	}
+	loadConfig(configPath)
+	if !auth.IsStreamKeyRequired() {
+		fmt.Fprintln(os.Stderr, "the stream key secret is not set")
+		os.Exit(1)
+	}
+	fmt.Println(auth.IssueStreamKey(args[0]))
+}
+
 func main() {
 
+	if len(os.Args) > 2 && os.Args[1] == "keygen" {
+		keygen(os.Args[2:])
+		return
+	}
+
+	configPath := ""
 	if len(os.Args) > 1 {
-		envFilePath := os.Args[1]
-		godotenv.Load(envFilePath)
+		configPath = os.Args[1]
 	}
+	serverConfig := loadConfig(configPath)
 
 	if os.Getenv("GO_ENV") != "release" {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -36,13 +79,21 @@ func main() {
 	}
 	e := createMux()
 
+	if !auth.IsStreamKeyRequired() {
+		log.Warn().Msg("the stream key secret is not set, capture client routes are not authenticated")
+	}
+
 	g := e.Group("/api")
 
 	server := socketio.NewServer(nil)
 	go server.Serve()
 	defer server.Close()
 
-	stream.StartSignalingServer(g, server)
+	stream.StartSignalingServer(g, server, serverConfig)
+
+	if serverConfig.Features.Metrics {
+		e.GET("/metrics", metrics.Handler, auth.RequireMetricsToken)
+	}
 
 	e.Any("/api/socket/", func(context echo.Context) error {
 		server.ServeHTTP(context.Response(), context.Request())
@@ -50,19 +101,33 @@ func main() {
 	})
 
 	if os.Getenv("GO_ENV") == "release" {
-		port := os.Getenv("PORT")
-		if port == "" {
-			port = "3000"
-		}
 		e.Use(middleware.StaticWithConfig(middleware.StaticConfig{
 			Root:  "webapp",
 			Index: "index.html",
 			HTML5: true,
 		}))
-		e.Start(":" + port)
+	}
+
+	log.Info().
+		Str("address", serverConfig.ListenAddress).
+		Bool("tls", serverConfig.IsTLS()).
+		Msg("starting the server")
 
+	if serverConfig.IsTLS() {
+		// read as bytes, echo resolves the file paths relative to the working directory only
+		cert, err := os.ReadFile(serverConfig.TLS.CertFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read the tls certificate")
+		}
+		key, err := os.ReadFile(serverConfig.TLS.KeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read the tls key")
+		}
+		err = echo.StartConfig{Address: serverConfig.ListenAddress}.StartTLS(e, cert, key)
+		log.Fatal().Err(err).Send()
 	} else {
-		e.Start(":4000")
+		err := e.Start(serverConfig.ListenAddress)
+		log.Fatal().Err(err).Send()
 	}
 
 }
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"signaling/main/config"
+
+	"github.com/labstack/echo/v5"
+	"github.com/rs/zerolog/log"
+)
+
+func getAdminToken() string {
+	return config.Get().AdminToken
+}
+
+// the admin api is only available if the feature is enabled and the admin token is set
+func IsAdminEnabled() bool {
+	return config.Get().Features.Admin && getAdminToken() != ""
+}
+
+// RequireAdminToken rejects calls to the admin api without the admin token as bearer token
+func RequireAdminToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !IsAdminEnabled() {
+			return c.String(http.StatusNotFound, "{\"message\":\"admin api is disabled\"}")
+		}
+		authorization := c.Request().Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if !strings.HasPrefix(authorization, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(getAdminToken())) != 1 {
+			log.Warn().
+				Str("path", c.Path()).
+				Msg("rejected admin call with invalid token")
+			return c.String(http.StatusUnauthorized, "{\"message\":\"invalid admin token\"}")
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"signaling/main/config"
+
+	"github.com/labstack/echo/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// the capture client sends its stream key in this header on the internal routes
+const StreamKeyHeader = "X-Stream-Key"
+
+func getStreamKeySecret() string {
+	return config.Get().StreamKeySecret
+}
+
+// if no secret is configured, the internal routes stay open like before
+func IsStreamKeyRequired() bool {
+	return getStreamKeySecret() != ""
+}
+
+// the stream key is the hex encoded HMAC-SHA256 of the user-facing stream id,
+// signed with the stream key secret
+func IssueStreamKey(streamId string) string {
+	mac := hmac.New(sha256.New, []byte(getStreamKeySecret()))
+	mac.Write([]byte(streamId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// the registry stores the hash of the key the stream was published with
+func HashStreamKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func VerifyStreamKey(streamId string, key string) bool {
+	if !IsStreamKeyRequired() {
+		return true
+	}
+	if key == "" {
+		return false
+	}
+	expected := IssueStreamKey(streamId)
+	return hmac.Equal([]byte(expected), []byte(key))
+}
+
+// the capture client sends the key in the X-Stream-Key header,
+// WHIP clients send it as a bearer token
+func GetStreamKey(c echo.Context) string {
+	key := c.Request().Header.Get(StreamKeyHeader)
+	if key != "" {
+		return key
+	}
+	authorization := c.Request().Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return ""
+}
+
+// RequireStreamKey rejects calls to the capture client routes without a valid stream key
+func RequireStreamKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		key := GetStreamKey(c)
+		if !VerifyStreamKey(streamId, key) {
+			log.Warn().
+				Str("streamId", streamId).
+				Str("path", c.Path()).
+				Msg("rejected call with invalid stream key")
+			return c.String(http.StatusUnauthorized, "{\"message\":\"invalid stream key\"}")
+		}
+		return next(c)
+	}
+}
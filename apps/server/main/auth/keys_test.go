@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"testing"
+
+	"signaling/main/config"
+)
+
+// loads the config with the secrets from the environment, Get returns it until the next load
+func loadSecrets(t *testing.T, streamKeySecret string, viewerTokenSecret string) {
+	t.Helper()
+	t.Setenv("STREAM_KEY_SECRET", streamKeySecret)
+	t.Setenv("VIEWER_TOKEN_SECRET", viewerTokenSecret)
+	if _, err := config.Load(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssueStreamKey(t *testing.T) {
+	loadSecrets(t, "secret", "")
+	// HMAC-SHA256("secret", "stream_test")
+	want := "b75823dbc984f8b6a1f7c50619e99e00333fd4aca38dd70b1e08187c3195f2ed"
+	if got := IssueStreamKey("stream_test"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestVerifyStreamKey(t *testing.T) {
+	loadSecrets(t, "secret", "")
+	key := IssueStreamKey("stream_test")
+	tampered := []byte(key)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name     string
+		streamId string
+		key      string
+		want     bool
+	}{
+		{"valid", "stream_test", key, true},
+		{"tampered", "stream_test", string(tampered), false},
+		{"other stream", "other", key, false},
+		{"truncated", "stream_test", key[:len(key)-1], false},
+		{"empty", "stream_test", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := VerifyStreamKey(test.streamId, test.key); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyStreamKeyWithoutSecret(t *testing.T) {
+	loadSecrets(t, "", "")
+	if IsStreamKeyRequired() {
+		t.Fatal("the stream key is required without a secret")
+	}
+	if !VerifyStreamKey("stream_test", "") {
+		t.Error("the internal routes are open without a secret")
+	}
+}
+
+func TestHashStreamKey(t *testing.T) {
+	if got := HashStreamKey(""); got != "" {
+		t.Errorf("got %q for an empty key", got)
+	}
+	if HashStreamKey("a") == HashStreamKey("b") {
+		t.Error("different keys have the same hash")
+	}
+}
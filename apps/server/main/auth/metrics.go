@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"signaling/main/config"
+
+	"github.com/labstack/echo/v5"
+)
+
+// RequireMetricsToken protects the metrics endpoint with the metrics token as bearer token, if it's set
+func RequireMetricsToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		metricsToken := config.Get().MetricsToken
+		if metricsToken == "" {
+			return next(c)
+		}
+		authorization := c.Request().Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if !strings.HasPrefix(authorization, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+			return c.String(http.StatusUnauthorized, "{\"message\":\"invalid metrics token\"}")
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// short-lived TURN credentials, the scheme of the TURN REST API supported by coturn:
+// username = "<expiry unix>:<user id>", password = base64(HMAC-SHA1(secret, username))
+
+type TurnCredentials struct {
+	Username  string
+	Password  string
+	ExpiresAt time.Time
+}
+
+func SignTurnUsername(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func IssueTurnCredentials(secret string, userId string, ttl time.Duration) TurnCredentials {
+	expiresAt := time.Now().Add(ttl)
+	username := fmt.Sprintf("%d:%s", expiresAt.Unix(), userId)
+	return TurnCredentials{
+		Username:  username,
+		Password:  SignTurnUsername(secret, username),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// IsTurnUsernameExpired checks the expiry part of the username
+func IsTurnUsernameExpired(username string) bool {
+	expiry, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+	if err != nil {
+		return true
+	}
+	return time.Now().Unix() > expiry
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignTurnUsername(t *testing.T) {
+	// base64(HMAC-SHA1("secret", "1700000000:viewer")), as computed by coturn
+	want := "oM0zaUZqq3ijUierm/zT52Njhss="
+	if got := SignTurnUsername("secret", "1700000000:viewer"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if SignTurnUsername("other", "1700000000:viewer") == want {
+		t.Error("the password doesn't depend on the secret")
+	}
+	if SignTurnUsername("secret", "1700000001:viewer") == want {
+		t.Error("the password doesn't depend on the expiry")
+	}
+}
+
+func TestIssueTurnCredentials(t *testing.T) {
+	credentials := IssueTurnCredentials("secret", "viewer", time.Hour)
+	if !strings.HasSuffix(credentials.Username, ":viewer") {
+		t.Errorf("username %q doesn't end with the user id", credentials.Username)
+	}
+	if credentials.Password != SignTurnUsername("secret", credentials.Username) {
+		t.Error("the password isn't the signature of the username")
+	}
+	if expiry := strings.SplitN(credentials.Username, ":", 2)[0]; expiry != strconv.FormatInt(credentials.ExpiresAt.Unix(), 10) {
+		t.Errorf("the username expiry %s doesn't match ExpiresAt", expiry)
+	}
+	if IsTurnUsernameExpired(credentials.Username) {
+		t.Error("new credentials are expired")
+	}
+}
+
+func TestIsTurnUsernameExpired(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name     string
+		username string
+		want     bool
+	}{
+		{"valid", future + ":viewer", false},
+		{"without user id", future, false},
+		{"expired", past + ":viewer", true},
+		{"no expiry", "viewer", true},
+		{"invalid expiry", "abc:viewer", true},
+		{"empty", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsTurnUsernameExpired(test.username); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"signaling/main/config"
+
+	"github.com/labstack/echo/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const DefaultViewerTokenTTL = time.Hour * 12
+
+// without a configured secret the tokens are only valid until the server is restarted
+var fallbackViewerTokenSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+func getViewerTokenSecret() []byte {
+	if secret := config.Get().ViewerTokenSecret; secret != "" {
+		return []byte(secret)
+	}
+	if secret := getStreamKeySecret(); secret != "" {
+		return []byte("viewer:" + secret)
+	}
+	return fallbackViewerTokenSecret
+}
+
+func signViewerToken(streamId string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, getViewerTokenSecret())
+	mac.Write([]byte(fmt.Sprintf("%s:%d", streamId, expiresAt)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IssueViewerToken returns a token allowing to watch the stream until it expires,
+// in the format <expiresAt>.<signature>
+func IssueViewerToken(streamId string, ttl time.Duration) (string, time.Time) {
+	expiresAt := time.Now().Add(ttl)
+	token := fmt.Sprintf("%d.%s", expiresAt.Unix(), signViewerToken(streamId, expiresAt.Unix()))
+	return token, expiresAt
+}
+
+func VerifyViewerToken(streamId string, token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	expected := signViewerToken(streamId, expiresAt)
+	return hmac.Equal([]byte(expected), []byte(parts[1]))
+}
+
+func HashViewerPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func VerifyViewerPassword(hash string, password string) bool {
+	if hash == "" || password == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// GetViewerCredentials returns the password and the token sent by the viewer,
+// the token can also be sent as a bearer token by WHEP players
+func GetViewerCredentials(c echo.Context) (password string, token string) {
+	password = c.QueryParam("password")
+	if password == "" {
+		password = c.Request().Header.Get("X-Viewer-Password")
+	}
+	token = c.QueryParam("token")
+	authorization := c.Request().Header.Get("Authorization")
+	if token == "" && strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return password, token
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyViewerToken(t *testing.T) {
+	loadSecrets(t, "", "viewer-secret")
+	token, expiresAt := IssueViewerToken("stream_test", time.Hour)
+	expired, _ := IssueViewerToken("stream_test", -time.Minute)
+	signature := strings.SplitN(token, ".", 2)[1]
+	tamperedSignature := []byte(token)
+	tamperedSignature[len(tamperedSignature)-1] ^= 1
+	// the expiry is signed, extending it invalidates the token
+	extended := fmt.Sprintf("%d.%s", expiresAt.Add(time.Hour).Unix(), signature)
+
+	tests := []struct {
+		name     string
+		streamId string
+		token    string
+		want     bool
+	}{
+		{"valid", "stream_test", token, true},
+		{"expired", "stream_test", expired, false},
+		{"tampered signature", "stream_test", string(tamperedSignature), false},
+		{"extended expiry", "stream_test", extended, false},
+		{"other stream", "other", token, false},
+		{"no signature", "stream_test", strings.SplitN(token, ".", 2)[0], false},
+		{"invalid expiry", "stream_test", "never." + signature, false},
+		{"empty", "stream_test", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := VerifyViewerToken(test.streamId, test.token); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyViewerTokenSecretChanged(t *testing.T) {
+	loadSecrets(t, "", "viewer-secret")
+	token, _ := IssueViewerToken("stream_test", time.Hour)
+	loadSecrets(t, "", "other-secret")
+	if VerifyViewerToken("stream_test", token) {
+		t.Error("the token is valid with another secret")
+	}
+}
+
+func TestVerifyViewerPassword(t *testing.T) {
+	hash, err := HashViewerPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty, _ := HashViewerPassword(""); empty != "" {
+		t.Errorf("got hash %q for an empty password", empty)
+	}
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"valid", hash, "password", true},
+		{"wrong", hash, "passwore", false},
+		{"empty password", hash, "", false},
+		{"no password set", "", "password", false},
+		{"both empty", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := VerifyViewerPassword(test.hash, test.password); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
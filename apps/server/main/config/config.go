@@ -0,0 +1,377 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls" json:"urls"`
+	Username   string   `yaml:"username" json:"username,omitempty"`
+	Credential string   `yaml:"credential" json:"credential,omitempty"`
+	// the shared secret of a TURN server supporting the TURN REST API(coturn: use-auth-secret),
+	// the server issues short-lived credentials instead of handing out a static username and credential
+	Secret string `yaml:"secret" json:"secret,omitempty"`
+}
+
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// the optional features of the server, all of them are enabled by default
+type Features struct {
+	Whip    bool `yaml:"whip"`
+	Whep    bool `yaml:"whep"`
+	Admin   bool `yaml:"admin"`
+	Metrics bool `yaml:"metrics"`
+}
+
+// the TURN/STUN server embedded in the signaling server
+type Turn struct {
+	Enabled bool `yaml:"enabled"`
+	// udp and tcp
+	ListenAddress string `yaml:"listen_address"`
+	// the address advertised to the clients and used for the relayed connections
+	PublicIP string `yaml:"public_ip"`
+	Realm    string `yaml:"realm"`
+	// signs the short-lived credentials, random if not set
+	Secret string `yaml:"secret"`
+}
+
+// the ICE settings of the server's own peer connections(SFU, WHIP, WHEP)
+type ICE struct {
+	// all the peer connections share a single UDP port, 0 allocates a port per connection
+	UDPMuxPort int `yaml:"udp_mux_port"`
+	// ICE-TCP candidates on a single port, 0 disables ICE-TCP
+	TCPMuxPort int `yaml:"tcp_mux_port"`
+	// public IPs advertised as host candidates, when the server is behind a 1:1 NAT(docker, cloud)
+	NAT1To1IPs []string `yaml:"nat_1to1_ips"`
+	// the names of the network interfaces used for the candidates, all of them if empty
+	Interfaces []string `yaml:"interfaces"`
+	// only the interfaces having an address in these IPs or CIDR ranges are used, all of them if empty
+	IPs []string `yaml:"ips"`
+}
+
+type Webhooks struct {
+	URLs   []string `yaml:"urls"`
+	Secret string   `yaml:"secret"`
+}
+
+type Config struct {
+	ListenAddress      string      `yaml:"listen_address"`
+	DirectConnect      bool        `yaml:"direct_connect"`
+	ICEServers         []ICEServer `yaml:"ice_servers"`
+	TLS                TLS         `yaml:"tls"`
+	Features           Features    `yaml:"features"`
+	StreamKeySecret    string      `yaml:"stream_key_secret"`
+	ViewerTokenSecret  string      `yaml:"viewer_token_secret"`
+	AdminToken         string      `yaml:"admin_token"`
+	MetricsToken       string      `yaml:"metrics_token"`
+	StreamRegistryPath string      `yaml:"stream_registry_path"`
+	Webhooks           Webhooks    `yaml:"webhooks"`
+	Turn               Turn        `yaml:"turn"`
+	ICE                ICE         `yaml:"ice"`
+	// seconds, the lifetime of the issued TURN credentials
+	TurnCredentialTTL int `yaml:"turn_credential_ttl"`
+	// seconds, a stream terminated by the admin api can't connect again during this time
+	TerminatedStreamCooldown int `yaml:"terminated_stream_cooldown"`
+}
+
+// the loaded config, see Load
+var current = defaultConfig()
+
+func defaultListenAddress() string {
+	if os.Getenv("GO_ENV") == "release" {
+		return ":3000"
+	}
+	return ":4000"
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress: defaultListenAddress(),
+		ICEServers:    make([]ICEServer, 0),
+		Features: Features{
+			Whip:    true,
+			Whep:    true,
+			Admin:   true,
+			Metrics: true,
+		},
+		Webhooks: Webhooks{
+			URLs: make([]string, 0),
+		},
+		Turn: Turn{
+			ListenAddress: "0.0.0.0:3478",
+			Realm:         "gstreamer-go-wrtc-remote",
+		},
+		TurnCredentialTTL:        3600,
+		TerminatedStreamCooldown: 300,
+		ICE: ICE{
+			NAT1To1IPs: make([]string, 0),
+			Interfaces: make([]string, 0),
+			IPs:        make([]string, 0),
+		},
+	}
+}
+
+// Get returns the config loaded at startup
+func Get() *Config {
+	return current
+}
+
+func (config *Config) GetTurnCredentialTTL() time.Duration {
+	return time.Duration(config.TurnCredentialTTL) * time.Second
+}
+
+func (config *Config) GetTerminatedStreamCooldown() time.Duration {
+	return time.Duration(config.TerminatedStreamCooldown) * time.Second
+}
+
+// IsTLS is true if the server is started with the certificate and key files
+func (config *Config) IsTLS() bool {
+	return config.TLS.CertFile != "" && config.TLS.KeyFile != ""
+}
+
+// Load reads the YAML config file if the path is not empty, applies the environment variables
+// over it and validates the result. The loaded config is returned by Get.
+func Load(path string) (*Config, error) {
+	config := defaultConfig()
+	// empty unless the file sets it, PORT doesn't override a configured listen address
+	config.ListenAddress = ""
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse the config file %s: %w", path, err)
+		}
+	}
+
+	problems := applyEnv(config)
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid config:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	current = config
+	return config, nil
+}
+
+func lookupString(name string, target *string) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		*target = value
+	}
+}
+
+func lookupInt(name string, target *int, problems *[]string) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s must be a number, got %q", name, value))
+		return
+	}
+	*target = parsed
+}
+
+// comma separated values
+func lookupList(name string, target *[]string) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	*target = make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*target = append(*target, item)
+		}
+	}
+}
+
+func lookupBool(name string, target *bool, problems *[]string) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s must be true or false, got %q", name, value))
+		return
+	}
+	*target = parsed
+}
+
+// the environment variables override the values of the config file
+func applyEnv(config *Config) []string {
+	problems := make([]string, 0)
+
+	lookupString("LISTEN_ADDRESS", &config.ListenAddress)
+	// the port assigned by the hosting platform, when neither the file nor LISTEN_ADDRESS set the listen address
+	if port := os.Getenv("PORT"); port != "" && config.ListenAddress == "" {
+		config.ListenAddress = ":" + port
+	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = defaultListenAddress()
+	}
+	lookupBool("DIRECT_CONNECT", &config.DirectConnect, &problems)
+	lookupString("TLS_CERT_FILE", &config.TLS.CertFile)
+	lookupString("TLS_KEY_FILE", &config.TLS.KeyFile)
+	lookupBool("FEATURE_WHIP", &config.Features.Whip, &problems)
+	lookupBool("FEATURE_WHEP", &config.Features.Whep, &problems)
+	lookupBool("FEATURE_ADMIN", &config.Features.Admin, &problems)
+	lookupBool("FEATURE_METRICS", &config.Features.Metrics, &problems)
+	lookupString("STREAM_KEY_SECRET", &config.StreamKeySecret)
+	lookupString("VIEWER_TOKEN_SECRET", &config.ViewerTokenSecret)
+	lookupString("ADMIN_TOKEN", &config.AdminToken)
+	lookupString("METRICS_TOKEN", &config.MetricsToken)
+	lookupString("STREAM_REGISTRY_PATH", &config.StreamRegistryPath)
+	lookupString("WEBHOOK_SECRET", &config.Webhooks.Secret)
+	lookupBool("TURN_ENABLED", &config.Turn.Enabled, &problems)
+	lookupString("TURN_LISTEN_ADDRESS", &config.Turn.ListenAddress)
+	lookupString("TURN_PUBLIC_IP", &config.Turn.PublicIP)
+	lookupString("TURN_REALM", &config.Turn.Realm)
+	lookupString("TURN_SECRET", &config.Turn.Secret)
+	lookupInt("TURN_CREDENTIAL_TTL", &config.TurnCredentialTTL, &problems)
+	lookupInt("TERMINATED_STREAM_COOLDOWN", &config.TerminatedStreamCooldown, &problems)
+	lookupList("WEBHOOK_URLS", &config.Webhooks.URLs)
+	lookupInt("ICE_UDP_MUX_PORT", &config.ICE.UDPMuxPort, &problems)
+	lookupInt("ICE_TCP_MUX_PORT", &config.ICE.TCPMuxPort, &problems)
+	lookupList("ICE_NAT_1TO1_IPS", &config.ICE.NAT1To1IPs)
+	lookupList("ICE_INTERFACES", &config.ICE.Interfaces)
+	lookupList("ICE_IPS", &config.ICE.IPs)
+
+	// a JSON array replaces the ICE servers of the config file
+	if value := os.Getenv("ICE_SERVERS"); value != "" {
+		iceServers := make([]ICEServer, 0)
+		if err := json.Unmarshal([]byte(value), &iceServers); err != nil {
+			problems = append(problems, fmt.Sprintf("ICE_SERVERS must be a JSON array of ice servers: %s", err))
+		} else {
+			config.ICEServers = iceServers
+		}
+	}
+
+	// the single STUN and TURN server of the older versions are added to the list
+	for _, prefix := range []string{"TURN_SERVER", "STUN_SERVER"} {
+		serverUrl := os.Getenv(prefix + "_URL")
+		if serverUrl == "" {
+			continue
+		}
+		config.ICEServers = append(config.ICEServers, ICEServer{
+			URLs:       []string{serverUrl},
+			Username:   os.Getenv(prefix + "_USERNAME"),
+			Credential: os.Getenv(prefix + "_PASSWORD"),
+			Secret:     os.Getenv(prefix + "_SECRET"),
+		})
+	}
+
+	return problems
+}
+
+func (config *Config) validate() []string {
+	problems := make([]string, 0)
+
+	if _, port, err := net.SplitHostPort(config.ListenAddress); err != nil {
+		problems = append(problems, fmt.Sprintf("listen_address %q must be host:port or :port", config.ListenAddress))
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		problems = append(problems, fmt.Sprintf("listen_address %q has an invalid port", config.ListenAddress))
+	}
+
+	for i, iceServer := range config.ICEServers {
+		if len(iceServer.URLs) == 0 {
+			problems = append(problems, fmt.Sprintf("ice_servers[%d] has no urls", i))
+		}
+		for _, iceUrl := range iceServer.URLs {
+			scheme := strings.SplitN(iceUrl, ":", 2)[0]
+			switch scheme {
+			case "stun", "stuns":
+			case "turn", "turns":
+				if iceServer.Secret == "" && (iceServer.Username == "" || iceServer.Credential == "") {
+					problems = append(problems, fmt.Sprintf("ice_servers[%d] %s requires a secret or a username and a credential", i, iceUrl))
+				}
+			default:
+				problems = append(problems, fmt.Sprintf("ice_servers[%d] %q must start with stun:, stuns:, turn: or turns:", i, iceUrl))
+			}
+		}
+	}
+
+	if config.ICE.UDPMuxPort < 0 || config.ICE.UDPMuxPort > 65535 {
+		problems = append(problems, fmt.Sprintf("ice.udp_mux_port %d must be between 0 and 65535", config.ICE.UDPMuxPort))
+	}
+	if config.ICE.TCPMuxPort < 0 || config.ICE.TCPMuxPort > 65535 {
+		problems = append(problems, fmt.Sprintf("ice.tcp_mux_port %d must be between 0 and 65535", config.ICE.TCPMuxPort))
+	}
+	if _, listenPort, err := net.SplitHostPort(config.ListenAddress); err == nil && config.ICE.TCPMuxPort != 0 &&
+		listenPort == strconv.Itoa(config.ICE.TCPMuxPort) {
+		problems = append(problems, "ice.tcp_mux_port must be different from the port of listen_address")
+	}
+	if _, turnPort, err := net.SplitHostPort(config.Turn.ListenAddress); err == nil && config.Turn.Enabled &&
+		(turnPort == strconv.Itoa(config.ICE.UDPMuxPort) || turnPort == strconv.Itoa(config.ICE.TCPMuxPort)) {
+		problems = append(problems, "the ice mux ports must be different from the port of turn.listen_address")
+	}
+	for _, ip := range config.ICE.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			problems = append(problems, fmt.Sprintf("ice.nat_1to1_ips %q is not an IP address", ip))
+		}
+	}
+	for _, ip := range config.ICE.IPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			problems = append(problems, fmt.Sprintf("ice.ips %q is not an IP address or CIDR range", ip))
+		}
+	}
+
+	if config.TurnCredentialTTL < 60 {
+		problems = append(problems, fmt.Sprintf("turn_credential_ttl must be at least 60 seconds, got %d", config.TurnCredentialTTL))
+	}
+	if config.TerminatedStreamCooldown < 0 {
+		problems = append(problems, fmt.Sprintf("terminated_stream_cooldown must not be negative, got %d", config.TerminatedStreamCooldown))
+	}
+
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		problems = append(problems, "tls requires both cert_file and key_file")
+	}
+	for _, file := range []string{config.TLS.CertFile, config.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("tls file %s is not readable: %s", file, err))
+		}
+	}
+
+	for _, webhookUrl := range config.Webhooks.URLs {
+		parsed, err := url.Parse(webhookUrl)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("webhooks url %q must be an http(s) url", webhookUrl))
+		}
+	}
+
+	if config.Turn.Enabled {
+		if _, port, err := net.SplitHostPort(config.Turn.ListenAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("turn.listen_address %q must be host:port", config.Turn.ListenAddress))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems = append(problems, fmt.Sprintf("turn.listen_address %q has an invalid port", config.Turn.ListenAddress))
+		}
+		if ip := net.ParseIP(config.Turn.PublicIP); ip == nil || ip.To4() == nil {
+			problems = append(problems, fmt.Sprintf("turn.public_ip %q must be an IPv4 address, required by the embedded turn server", config.Turn.PublicIP))
+		}
+		if config.Turn.Realm == "" {
+			problems = append(problems, "turn.realm must not be empty")
+		}
+	}
+
+	return problems
+}
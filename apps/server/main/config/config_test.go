@@ -0,0 +1,249 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the variables read by applyEnv, cleared so the environment of the test run doesn't leak in
+var envNames = []string{
+	"GO_ENV", "LISTEN_ADDRESS", "PORT", "DIRECT_CONNECT", "TLS_CERT_FILE", "TLS_KEY_FILE",
+	"FEATURE_WHIP", "FEATURE_WHEP", "FEATURE_ADMIN", "FEATURE_METRICS",
+	"STREAM_KEY_SECRET", "VIEWER_TOKEN_SECRET", "ADMIN_TOKEN", "METRICS_TOKEN", "STREAM_REGISTRY_PATH",
+	"WEBHOOK_SECRET", "WEBHOOK_URLS", "TURN_ENABLED", "TURN_LISTEN_ADDRESS", "TURN_PUBLIC_IP", "TURN_REALM",
+	"TURN_SECRET", "TURN_CREDENTIAL_TTL", "ICE_UDP_MUX_PORT", "ICE_TCP_MUX_PORT", "ICE_NAT_1TO1_IPS",
+	"ICE_INTERFACES", "ICE_IPS", "ICE_SERVERS", "TERMINATED_STREAM_COOLDOWN",
+	"TURN_SERVER_URL", "TURN_SERVER_USERNAME", "TURN_SERVER_PASSWORD", "TURN_SERVER_SECRET",
+	"STUN_SERVER_URL", "STUN_SERVER_USERNAME", "STUN_SERVER_PASSWORD", "STUN_SERVER_SECRET",
+}
+
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range envNames {
+		t.Setenv(name, "")
+	}
+}
+
+// writes the YAML to a config file, an empty YAML loads without a file
+func load(t *testing.T, yaml string, env map[string]string) (*Config, error) {
+	t.Helper()
+	clearEnv(t)
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	path := ""
+	if yaml != "" {
+		path = filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Load(path)
+}
+
+func TestLoadDefaults(t *testing.T) {
+	config, err := load(t, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != ":4000" {
+		t.Errorf("listen address %q, want :4000", config.ListenAddress)
+	}
+	if !config.Features.Whip || !config.Features.Whep || !config.Features.Admin || !config.Features.Metrics {
+		t.Errorf("the features aren't enabled by default: %+v", config.Features)
+	}
+	if config.TurnCredentialTTL != 3600 {
+		t.Errorf("turn credential ttl %d, want 3600", config.TurnCredentialTTL)
+	}
+	if config.GetTerminatedStreamCooldown() != 5*time.Minute {
+		t.Errorf("terminated stream cooldown %v, want 5m", config.GetTerminatedStreamCooldown())
+	}
+	if config.Turn.Enabled || config.Turn.ListenAddress != "0.0.0.0:3478" {
+		t.Errorf("unexpected turn defaults: %+v", config.Turn)
+	}
+	if len(config.ICEServers) != 0 || config.IsTLS() || config.DirectConnect {
+		t.Errorf("unexpected defaults: %+v", config)
+	}
+	if Get() != config {
+		t.Error("Get doesn't return the loaded config")
+	}
+}
+
+func TestLoadReleaseDefaults(t *testing.T) {
+	config, err := load(t, "", map[string]string{"GO_ENV": "release"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != ":3000" {
+		t.Errorf("listen address %q, want :3000", config.ListenAddress)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	config, err := load(t, `
+listen_address: 127.0.0.1:5000
+direct_connect: true
+features:
+  admin: false
+ice_servers:
+  - urls: ["stun:stun.example.com:3478"]
+turn_credential_ttl: 600
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != "127.0.0.1:5000" || !config.DirectConnect || config.TurnCredentialTTL != 600 {
+		t.Errorf("the file isn't applied: %+v", config)
+	}
+	// the features missing from the file keep their defaults
+	if config.Features.Admin || !config.Features.Whip {
+		t.Errorf("unexpected features: %+v", config.Features)
+	}
+	if len(config.ICEServers) != 1 || config.ICEServers[0].URLs[0] != "stun:stun.example.com:3478" {
+		t.Errorf("unexpected ice servers: %+v", config.ICEServers)
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	config, err := load(t, `
+listen_address: :5000
+stream_key_secret: from-file
+ice_servers:
+  - urls: ["stun:file.example.com"]
+`, map[string]string{
+		"PORT":                       "6000",
+		"DIRECT_CONNECT":             "true",
+		"FEATURE_WHIP":               "false",
+		"STREAM_KEY_SECRET":          "from-env",
+		"TURN_CREDENTIAL_TTL":        "120",
+		"TERMINATED_STREAM_COOLDOWN": "0",
+		"WEBHOOK_URLS":               "https://a.example.com, ,https://b.example.com",
+		"ICE_NAT_1TO1_IPS":           "203.0.113.1",
+		"ICE_SERVERS":                `[{"urls":["stun:env.example.com"]}]`,
+		"TURN_SERVER_URL":            "turn:turn.example.com",
+		"TURN_SERVER_USERNAME":       "user",
+		"TURN_SERVER_PASSWORD":       "password",
+		"STUN_SERVER_URL":            "stun:stun.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != ":5000" {
+		t.Errorf("PORT overrides the listen address of the file: %q", config.ListenAddress)
+	}
+	if !config.DirectConnect || config.Features.Whip || config.StreamKeySecret != "from-env" || config.TurnCredentialTTL != 120 ||
+		config.TerminatedStreamCooldown != 0 {
+		t.Errorf("the env isn't applied: %+v", config)
+	}
+	if strings.Join(config.Webhooks.URLs, ",") != "https://a.example.com,https://b.example.com" {
+		t.Errorf("unexpected webhook urls: %v", config.Webhooks.URLs)
+	}
+	if len(config.ICE.NAT1To1IPs) != 1 || config.ICE.NAT1To1IPs[0] != "203.0.113.1" {
+		t.Errorf("unexpected nat 1:1 ips: %v", config.ICE.NAT1To1IPs)
+	}
+	// ICE_SERVERS replaces the file, the legacy servers are added to it
+	urls := make([]string, 0)
+	for _, iceServer := range config.ICEServers {
+		urls = append(urls, iceServer.URLs...)
+	}
+	if strings.Join(urls, ",") != "stun:env.example.com,turn:turn.example.com,stun:stun.example.com" {
+		t.Errorf("unexpected ice servers: %v", urls)
+	}
+	if config.ICEServers[1].Username != "user" || config.ICEServers[1].Credential != "password" {
+		t.Errorf("the legacy turn credentials aren't applied: %+v", config.ICEServers[1])
+	}
+}
+
+func TestLoadListenAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+		want string
+	}{
+		{"default", "", nil, ":4000"},
+		{"port", "", map[string]string{"PORT": "6000"}, ":6000"},
+		{"port in release", "", map[string]string{"GO_ENV": "release", "PORT": "6000"}, ":6000"},
+		{"env over port", "", map[string]string{"LISTEN_ADDRESS": "127.0.0.1:7000", "PORT": "6000"}, "127.0.0.1:7000"},
+		{"file over port", "listen_address: :5000", map[string]string{"PORT": "6000"}, ":5000"},
+		{"env over file", "listen_address: :5000", map[string]string{"LISTEN_ADDRESS": ":7000"}, ":7000"},
+		{"file without listen address", "direct_connect: true", map[string]string{"PORT": "6000"}, ":6000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := load(t, test.yaml, test.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ListenAddress != test.want {
+				t.Errorf("listen address %q, want %q", config.ListenAddress, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+		want string
+	}{
+		{"invalid number", "", map[string]string{"TURN_CREDENTIAL_TTL": "hour"}, `TURN_CREDENTIAL_TTL must be a number, got "hour"`},
+		{"invalid bool", "", map[string]string{"FEATURE_WHIP": "maybe"}, `FEATURE_WHIP must be true or false, got "maybe"`},
+		{"invalid ice servers", "", map[string]string{"ICE_SERVERS": "stun:a"}, "ICE_SERVERS must be a JSON array of ice servers"},
+		{"listen address", "listen_address: localhost", nil, `listen_address "localhost" must be host:port or :port`},
+		{"listen port", "listen_address: :http", nil, `listen_address ":http" has an invalid port`},
+		{"ice server without urls", "ice_servers:\n  - username: user", nil, "ice_servers[0] has no urls"},
+		{"turn without credentials", "ice_servers:\n  - urls: [\"turn:a.example.com\"]", nil, "ice_servers[0] turn:a.example.com requires a secret or a username and a credential"},
+		{"ice url scheme", "ice_servers:\n  - urls: [\"http://a.example.com\"]", nil, `ice_servers[0] "http://a.example.com" must start with stun:, stuns:, turn: or turns:`},
+		{"udp mux port", "ice:\n  udp_mux_port: 70000", nil, "ice.udp_mux_port 70000 must be between 0 and 65535"},
+		{"tcp mux port", "ice:\n  tcp_mux_port: -1", nil, "ice.tcp_mux_port -1 must be between 0 and 65535"},
+		{"tcp mux port of listen address", "ice:\n  tcp_mux_port: 4000", nil, "ice.tcp_mux_port must be different from the port of listen_address"},
+		{"mux port of turn", "ice:\n  udp_mux_port: 3478\nturn:\n  enabled: true\n  public_ip: 203.0.113.1", nil, "the ice mux ports must be different from the port of turn.listen_address"},
+		{"nat 1:1 ip", "ice:\n  nat_1to1_ips: [\"example.com\"]", nil, `ice.nat_1to1_ips "example.com" is not an IP address`},
+		{"ice ip", "ice:\n  ips: [\"10.0.0.0/33\"]", nil, `ice.ips "10.0.0.0/33" is not an IP address or CIDR range`},
+		{"turn credential ttl", "turn_credential_ttl: 30", nil, "turn_credential_ttl must be at least 60 seconds, got 30"},
+		{"terminated stream cooldown", "terminated_stream_cooldown: -1", nil, "terminated_stream_cooldown must not be negative, got -1"},
+		{"tls key missing", "tls:\n  cert_file: cert.pem", nil, "tls requires both cert_file and key_file"},
+		{"tls file missing", "tls:\n  cert_file: /nonexistent/cert.pem\n  key_file: /nonexistent/key.pem", nil, "tls file /nonexistent/cert.pem is not readable"},
+		{"webhook url", "webhooks:\n  urls: [\"ftp://a.example.com\"]", nil, `webhooks url "ftp://a.example.com" must be an http(s) url`},
+		{"turn listen address", "turn:\n  enabled: true\n  listen_address: turn\n  public_ip: 203.0.113.1", nil, `turn.listen_address "turn" must be host:port`},
+		{"turn listen port", "turn:\n  enabled: true\n  listen_address: :turn\n  public_ip: 203.0.113.1", nil, `turn.listen_address ":turn" has an invalid port`},
+		{"turn public ip", "turn:\n  enabled: true\n  public_ip: 2001:db8::1", nil, `turn.public_ip "2001:db8::1" must be an IPv4 address, required by the embedded turn server`},
+		{"turn realm", "turn:\n  enabled: true\n  public_ip: 203.0.113.1\n  realm: \"\"", nil, "turn.realm must not be empty"},
+		{"invalid yaml", "listen_address: [", nil, "failed to parse the config file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := load(t, test.yaml, test.env)
+			if err == nil {
+				t.Fatalf("loaded %+v, want error %q", config, test.want)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %q, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	clearEnv(t)
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil || !strings.Contains(err.Error(), "failed to read the config file") {
+		t.Errorf("got error %v for a missing file", err)
+	}
+}
+
+// every problem is reported at once
+func TestLoadReportsAllProblems(t *testing.T) {
+	_, err := load(t, "listen_address: localhost\nturn_credential_ttl: 30", map[string]string{"FEATURE_WHEP": "maybe"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if count := strings.Count(err.Error(), "\n  - "); count != 3 {
+		t.Errorf("got %d problems, want 3: %s", count, err)
+	}
+}
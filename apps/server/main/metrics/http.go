@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v5"
+)
+
+// Middleware records the count and latency of the requests by route
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			}
+		}
+		route := c.Path()
+		method := c.Request().Method
+		HttpRequests.Inc(route, method, strconv.Itoa(status))
+		HttpRequestDuration.Observe(time.Since(start).Seconds(), route, method)
+		return err
+	}
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	Write(c.Response())
+	return nil
+}
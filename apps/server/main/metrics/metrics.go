@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a minimal implementation of the prometheus text exposition format,
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type Series struct {
+	labelValues []string
+	value       float64
+	// histogram only
+	bucketCounts []uint64
+	count        uint64
+	mutex        sync.Mutex
+}
+
+type Metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*Series
+	mutex      sync.Mutex
+}
+
+var (
+	metrics      = make([]*Metric, 0)
+	collectors   = make([]func(), 0)
+	metricsMutex = sync.Mutex{}
+)
+
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15}
+
+func newMetric(name string, help string, kind string, buckets []float64, labelNames []string) *Metric {
+	metric := &Metric{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*Series),
+	}
+	metricsMutex.Lock()
+	metrics = append(metrics, metric)
+	metricsMutex.Unlock()
+	return metric
+}
+
+func NewCounter(name string, help string, labelNames ...string) *Metric {
+	return newMetric(name, help, "counter", nil, labelNames)
+}
+
+func NewGauge(name string, help string, labelNames ...string) *Metric {
+	return newMetric(name, help, "gauge", nil, labelNames)
+}
+
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Metric {
+	return newMetric(name, help, "histogram", buckets, labelNames)
+}
+
+// OnCollect registers a callback which runs before every scrape, to update the gauges
+func OnCollect(cb func()) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	collectors = append(collectors, cb)
+}
+
+// With returns the series of the label values, in the order of the label names
+func (metric *Metric) With(labelValues ...string) *Series {
+	if len(labelValues) != len(metric.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", metric.name, len(metric.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+	series := metric.series[key]
+	if series == nil {
+		series = &Series{
+			labelValues:  labelValues,
+			bucketCounts: make([]uint64, len(metric.buckets)),
+		}
+		metric.series[key] = series
+	}
+	return series
+}
+
+// Reset removes all the series, used by the gauges which are recomputed on every scrape
+func (metric *Metric) Reset() {
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+	metric.series = make(map[string]*Series)
+}
+
+func (metric *Metric) Inc(labelValues ...string) {
+	metric.With(labelValues...).Add(1)
+}
+
+func (metric *Metric) Add(value float64, labelValues ...string) {
+	metric.With(labelValues...).Add(value)
+}
+
+func (metric *Metric) Set(value float64, labelValues ...string) {
+	metric.With(labelValues...).Set(value)
+}
+
+func (metric *Metric) Observe(value float64, labelValues ...string) {
+	series := metric.With(labelValues...)
+	series.mutex.Lock()
+	defer series.mutex.Unlock()
+	series.value += value
+	series.count++
+	for i, bound := range metric.buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+		}
+	}
+}
+
+func (series *Series) Add(value float64) {
+	series.mutex.Lock()
+	series.value += value
+	series.mutex.Unlock()
+}
+
+func (series *Series) Set(value float64) {
+	series.mutex.Lock()
+	series.value = value
+	series.mutex.Unlock()
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return strings.ReplaceAll(value, "\n", "\\n")
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=\"" + escapeLabelValue(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (metric *Metric) write(w io.Writer) {
+	metric.mutex.Lock()
+	keys := make([]string, 0, len(metric.series))
+	for key := range metric.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*Series, len(keys))
+	for i, key := range keys {
+		series[i] = metric.series[key]
+	}
+	metric.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+	for _, s := range series {
+		s.mutex.Lock()
+		if metric.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", metric.name, formatLabels(metric.labelNames, s.labelValues), formatValue(s.value))
+			s.mutex.Unlock()
+			continue
+		}
+		bucketLabelNames := append(append([]string{}, metric.labelNames...), "le")
+		for i, bound := range metric.buckets {
+			bucketLabelValues := append(append([]string{}, s.labelValues...), formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", metric.name, formatLabels(bucketLabelNames, bucketLabelValues), s.bucketCounts[i])
+		}
+		infLabelValues := append(append([]string{}, s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", metric.name, formatLabels(bucketLabelNames, infLabelValues), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", metric.name, formatLabels(metric.labelNames, s.labelValues), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", metric.name, formatLabels(metric.labelNames, s.labelValues), s.count)
+		s.mutex.Unlock()
+	}
+}
+
+// Write runs the collectors and writes all the metrics in the text format
+func Write(w io.Writer) {
+	metricsMutex.Lock()
+	_collectors := append([]func(){}, collectors...)
+	_metrics := append([]*Metric{}, metrics...)
+	metricsMutex.Unlock()
+
+	for _, collect := range _collectors {
+		collect()
+	}
+	for _, metric := range _metrics {
+		metric.write(w)
+	}
+}
@@ -0,0 +1,64 @@
+package metrics
+
+// the stream labels are the user facing stream ids, without the run id
+
+var ActiveStreams = NewGauge(
+	"signaling_active_streams",
+	"Number of available streams by mode (sfu, direct, whip).",
+	"mode",
+)
+
+var StreamViewers = NewGauge(
+	"signaling_stream_viewers",
+	"Number of viewers connected to the stream.",
+	"stream",
+)
+
+var HttpRequests = NewCounter(
+	"signaling_http_requests_total",
+	"Number of signaling http requests by route, method and status.",
+	"route", "method", "status",
+)
+
+var HttpRequestDuration = NewHistogram(
+	"signaling_http_request_duration_seconds",
+	"Latency of the signaling http requests by route and method.",
+	DefaultLatencyBuckets,
+	"route", "method",
+)
+
+var ForwardedRtpBytes = NewCounter(
+	"signaling_forwarded_rtp_bytes_total",
+	"RTP bytes received from the publisher and forwarded to the viewers, per track.",
+	"stream", "track", "kind",
+)
+
+var ForwardedRtpPackets = NewCounter(
+	"signaling_forwarded_rtp_packets_total",
+	"RTP packets received from the publisher and forwarded to the viewers, per track.",
+	"stream", "track", "kind",
+)
+
+var PLIsSent = NewCounter(
+	"signaling_pli_sent_total",
+	"Picture loss indications sent to the publisher.",
+	"stream",
+)
+
+var RetransmittedRtpPackets = NewCounter(
+	"signaling_retransmitted_rtp_packets_total",
+	"RTP packets retransmitted to the viewers from the packet history, on their NACKs.",
+	"stream",
+)
+
+var NacksForwarded = NewCounter(
+	"signaling_nack_forwarded_total",
+	"Lost packets missing from the packet history, requested from the publisher.",
+	"stream",
+)
+
+var PeerConnectionStateTransitions = NewCounter(
+	"signaling_peer_connection_state_transitions_total",
+	"Peer connection state changes by role (publisher, viewer) and new state.",
+	"stream", "role", "state",
+)
@@ -0,0 +1,212 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type StreamRecord struct {
+	StreamId        string `json:"streamId"`
+	IsDirectConnect bool   `json:"directConnect"`
+	IsPrivate       bool   `json:"private"`
+	IsRemoteEnabled bool   `json:"remoteEnabled"`
+	SimulcastLayers int    `json:"simulcastLayers,omitempty"`
+	HasFallback     bool   `json:"hasFallback,omitempty"`
+	Owner           string `json:"owner"`
+	KeyHash         string `json:"keyHash,omitempty"`
+	// bcrypt hash of the viewer password
+	ViewerPasswordHash string    `json:"viewerPasswordHash,omitempty"`
+	CreatedAt          time.Time `json:"createdAt"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+}
+
+type registryFile struct {
+	Streams map[string]StreamRecord `json:"streams"`
+	// streamId -> blocked at
+	Blocked map[string]time.Time `json:"blocked"`
+}
+
+// Registry stores the stream records and the blocked stream ids in a local database file,
+// so the streams can be restored after the server is restarted
+type Registry struct {
+	IsPersistent bool
+	Get          func(streamId string) *StreamRecord
+	GetAll       func() []StreamRecord
+	Save         func(record StreamRecord) error
+	Remove       func(streamId string) error
+	Block        func(streamId string) error
+	Unblock      func(streamId string) error
+	IsBlocked    func(streamId string) bool
+	GetBlocked   func() map[string]time.Time
+}
+
+func load(path string) (*registryFile, error) {
+	file := &registryFile{
+		Streams: make(map[string]StreamRecord),
+		Blocked: make(map[string]time.Time),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	if file.Streams == nil {
+		file.Streams = make(map[string]StreamRecord)
+	}
+	if file.Blocked == nil {
+		file.Blocked = make(map[string]time.Time)
+	}
+	return file, nil
+}
+
+// the file is replaced atomically, a crash can't leave a half written registry behind
+func write(path string, file *registryFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// OpenRegistry opens the registry file at path, creating it on the first write.
+// With an empty path the records are only kept in memory.
+func OpenRegistry(path string) (*Registry, error) {
+	file := &registryFile{
+		Streams: make(map[string]StreamRecord),
+		Blocked: make(map[string]time.Time),
+	}
+	isPersistent := path != ""
+
+	if isPersistent {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		loaded, err := load(path)
+		if err != nil {
+			return nil, err
+		}
+		file = loaded
+		log.Info().
+			Str("path", path).
+			Int("streams", len(file.Streams)).
+			Int("blocked", len(file.Blocked)).
+			Msg("stream registry loaded")
+	}
+	records := file.Streams
+	blocked := file.Blocked
+
+	mutex := sync.Mutex{}
+	persist := func() error {
+		if !isPersistent {
+			return nil
+		}
+		err := write(path, file)
+		if err != nil {
+			log.Err(err).Str("path", path).Msg("failed to write stream registry")
+		}
+		return err
+	}
+
+	return &Registry{
+		IsPersistent: isPersistent,
+		Get: func(streamId string) *StreamRecord {
+			mutex.Lock()
+			defer mutex.Unlock()
+			record, ok := records[streamId]
+			if !ok {
+				return nil
+			}
+			return &record
+		},
+		GetAll: func() []StreamRecord {
+			mutex.Lock()
+			defer mutex.Unlock()
+			all := make([]StreamRecord, 0, len(records))
+			for _, record := range records {
+				all = append(all, record)
+			}
+			return all
+		},
+		Save: func(record StreamRecord) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			now := time.Now()
+			if existing, ok := records[record.StreamId]; ok {
+				record.CreatedAt = existing.CreatedAt
+			} else {
+				record.CreatedAt = now
+			}
+			record.UpdatedAt = now
+			records[record.StreamId] = record
+			return persist()
+		},
+		Remove: func(streamId string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if _, ok := records[streamId]; !ok {
+				return nil
+			}
+			delete(records, streamId)
+			return persist()
+		},
+		Block: func(streamId string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			blocked[streamId] = time.Now()
+			return persist()
+		},
+		Unblock: func(streamId string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if _, ok := blocked[streamId]; !ok {
+				return nil
+			}
+			delete(blocked, streamId)
+			return persist()
+		},
+		IsBlocked: func(streamId string) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			_, ok := blocked[streamId]
+			return ok
+		},
+		GetBlocked: func() map[string]time.Time {
+			mutex.Lock()
+			defer mutex.Unlock()
+			all := make(map[string]time.Time, len(blocked))
+			for streamId, blockedAt := range blocked {
+				all[streamId] = blockedAt
+			}
+			return all
+		},
+	}, nil
+}
@@ -1,35 +1,193 @@
 package rtc
 
 import (
+	"fmt"
+	"net"
+	"sync"
+
+	"signaling/main/config"
+
+	"github.com/pion/ice/v2"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/logging"
 	"github.com/pion/webrtc/v3"
 )
 
-func SetupApi() *webrtc.API {
+// the read buffer of the ICE-TCP connections, in packets
+const tcpMuxReadBufferSize = 8
+
+// the muxes are shared by all the peer connections
+var (
+	udpMux    ice.UDPMux
+	tcpMux    ice.TCPMux
+	muxOnce   sync.Once
+	iceLogger = logging.NewDefaultLoggerFactory().NewLogger("ice")
+)
+
+func listenMuxes(iceConfig config.ICE) {
+	if iceConfig.UDPMuxPort != 0 {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: iceConfig.UDPMuxPort})
+		if err != nil {
+			panic(fmt.Errorf("failed to listen on the ice udp mux port: %w", err))
+		}
+		udpMux = webrtc.NewICEUDPMux(iceLogger, udpConn)
+	}
+	if iceConfig.TCPMuxPort != 0 {
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: iceConfig.TCPMuxPort})
+		if err != nil {
+			panic(fmt.Errorf("failed to listen on the ice tcp mux port: %w", err))
+		}
+		tcpMux = webrtc.NewICETCPMux(iceLogger, tcpListener, tcpMuxReadBufferSize)
+	}
+}
+
+// the IPs or CIDR ranges of the allowlist
+func parseIPFilter(ips []string) func(ip net.IP) bool {
+	ranges := make([]*net.IPNet, 0, len(ips))
+	for _, value := range ips {
+		if _, ipNet, err := net.ParseCIDR(value); err == nil {
+			ranges = append(ranges, ipNet)
+		} else if ip := net.ParseIP(value); ip != nil {
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		}
+	}
+	return func(ip net.IP) bool {
+		for _, ipNet := range ranges {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func interfaceHasIP(name string, ipFilter func(ip net.IP) bool) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipFilter(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func getSettingEngine() webrtc.SettingEngine {
+	iceConfig := config.Get().ICE
+	muxOnce.Do(func() {
+		listenMuxes(iceConfig)
+	})
+
+	settings := webrtc.SettingEngine{}
+	if udpMux != nil {
+		settings.SetICEUDPMux(udpMux)
+	}
+	if tcpMux != nil {
+		settings.SetICETCPMux(tcpMux)
+		settings.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4,
+			webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4,
+			webrtc.NetworkTypeTCP6,
+		})
+	}
+	if len(iceConfig.NAT1To1IPs) > 0 {
+		settings.SetNAT1To1IPs(iceConfig.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	if len(iceConfig.Interfaces) > 0 || len(iceConfig.IPs) > 0 {
+		interfaces := make(map[string]bool)
+		for _, name := range iceConfig.Interfaces {
+			interfaces[name] = true
+		}
+		ipFilter := parseIPFilter(iceConfig.IPs)
+		// the setting engine filters the interfaces only, an interface is used if it has an allowed address
+		settings.SetInterfaceFilter(func(name string) bool {
+			if len(interfaces) > 0 && !interfaces[name] {
+				return false
+			}
+			return len(iceConfig.IPs) == 0 || interfaceHasIP(name, ipFilter)
+		})
+	}
+	return settings
+}
+
+// the H264 profiles of the capture clients (openh264 and nvenc: baseline, x264: configurable), the forwarded
+// tracks keep the profile-level-id of the capture client
+var h264Profiles = []struct {
+	profileLevelId string
+	payloadType    webrtc.PayloadType
+}{
+	{"42e01f", 102},
+	{"4d001f", 104},
+	{"640c1f", 106},
+}
+
+// registers the RTX codec (RFC 4588) of a video codec, on the next payload type
+func registerRTX(engine *webrtc.MediaEngine, payloadType webrtc.PayloadType) error {
+	return engine.RegisterCodec(
+		webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeTypeRTX,
+				ClockRate:   90000,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", payloadType),
+			},
+			PayloadType: payloadType + 1,
+		},
+		webrtc.RTPCodecTypeVideo,
+	)
+}
+
+// SetupApi creates the API of a peer connection, the connections of the viewers negotiate RTX
+func SetupApi(negotiateRTX bool) *webrtc.API {
 	engine := &webrtc.MediaEngine{}
 
 	// Register Interceptors
 	i := &interceptor.Registry{}
 
-	err := webrtc.RegisterDefaultInterceptors(engine, i)
+	// the NACKs of the viewers are answered by the forwarders from the packet history shared by the viewers,
+	// instead of the NACK responder buffering the packets of every viewer
+	generator, err := nack.NewGeneratorInterceptor()
 	if err != nil {
 		panic(err)
 	}
+	i.Add(generator)
+	if err = webrtc.ConfigureRTCPReports(i); err != nil {
+		panic(err)
+	}
+	if err = webrtc.ConfigureTWCCSender(engine, i); err != nil {
+		panic(err)
+	}
 	fb := []webrtc.RTCPFeedback{}
-	err = engine.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeH264,
-			ClockRate:    90000,
-			Channels:     0,
-			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-			RTCPFeedback: fb,
+	videoFb := []webrtc.RTCPFeedback{
+		{Type: "nack"},
+		{Type: "nack", Parameter: "pli"},
+		{Type: "ccm", Parameter: "fir"},
+		// the bandwidth estimates of the viewers select their simulcast layers
+		{Type: "goog-remb"},
+	}
+	for _, profile := range h264Profiles {
+		err = engine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    90000,
+				Channels:     0,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile.profileLevelId,
+				RTCPFeedback: videoFb,
+			},
+			PayloadType: profile.payloadType,
 		},
-		PayloadType: 102,
-	},
-		webrtc.RTPCodecTypeVideo)
+			webrtc.RTPCodecTypeVideo)
 
-	if err != nil {
-		panic(err)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	err = engine.RegisterCodec(
@@ -39,7 +197,7 @@ func SetupApi() *webrtc.API {
 				ClockRate:    90000,
 				Channels:     0,
 				SDPFmtpLine:  "",
-				RTCPFeedback: fb,
+				RTCPFeedback: videoFb,
 			},
 			PayloadType: 96,
 		},
@@ -50,6 +208,42 @@ func SetupApi() *webrtc.API {
 		panic(err)
 	}
 
+	err = engine.RegisterCodec(
+		webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeVP9,
+				ClockRate:    90000,
+				Channels:     0,
+				SDPFmtpLine:  "profile-id=0",
+				RTCPFeedback: videoFb,
+			},
+			PayloadType: 98,
+		},
+		webrtc.RTPCodecTypeVideo,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = engine.RegisterCodec(
+		webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeAV1,
+				ClockRate:    90000,
+				Channels:     0,
+				SDPFmtpLine:  "",
+				RTCPFeedback: videoFb,
+			},
+			PayloadType: 100,
+		},
+		webrtc.RTPCodecTypeVideo,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
 	err = engine.RegisterCodec(
 		webrtc.RTPCodecParameters{
 			RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -66,14 +260,25 @@ func SetupApi() *webrtc.API {
 		panic(err)
 	}
 
+	if negotiateRTX {
+		videoPayloadTypes := []webrtc.PayloadType{96, 98, 100}
+		for _, profile := range h264Profiles {
+			videoPayloadTypes = append(videoPayloadTypes, profile.payloadType)
+		}
+		for _, payloadType := range videoPayloadTypes {
+			if err = registerRTX(engine, payloadType); err != nil {
+				panic(err)
+			}
+		}
+	}
+
 	// add default interceptors
 	// err = webrtc.RegisterDefaultInterceptors(engine, i)
-	// settings = webrtc.SettingEngine{}
 
 	api := webrtc.NewAPI(
 		webrtc.WithMediaEngine(engine),
 		webrtc.WithInterceptorRegistry(i),
-		// webrtc.WithSettingEngine(settings),
+		webrtc.WithSettingEngine(getSettingEngine()),
 	)
 
 	return api
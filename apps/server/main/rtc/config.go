@@ -1,8 +1,8 @@
 package rtc
 
 import (
-	"os"
-	"strconv"
+	"signaling/main/auth"
+	"signaling/main/config"
 )
 
 type Configuration struct {
@@ -10,53 +10,38 @@ type Configuration struct {
 	DirectConnect bool        `json:"directConnect"`
 }
 
-func GetRtcConfig() Configuration {
-	iceServers := make([]ICEServer, 0)
-	turn_server_url, hasEnv := os.LookupEnv("TURN_SERVER_URL")
-	if hasEnv && turn_server_url != "" {
-		iceServer := ICEServer{
-			URLs: []string{turn_server_url},
-		}
-		turn_server_username := os.Getenv("TURN_SERVER_USERNAME")
-		if turn_server_username != "" {
-			iceServer.Username = turn_server_username
-		}
-		turn_server_password := os.Getenv("TURN_SERVER_PASSWORD")
-		if turn_server_password != "" {
-			iceServer.Credential = turn_server_password
-			iceServer.CredentialType = "password"
-		}
-		iceServers = append(iceServers, iceServer)
-	}
+// the user id of the credentials used by the server's own peer connections
+const serverTurnUserId = "signaling-server"
 
-	stun_server_url, hasEnv := os.LookupEnv("STUN_SERVER_URL")
-	if hasEnv && stun_server_url != "" {
+// GetIceServers returns the configured ICE servers, the servers with a shared secret
+// get new short-lived credentials for the user
+func GetIceServers(userId string) []ICEServer {
+	serverConfig := config.Get()
+	iceServers := make([]ICEServer, 0, len(serverConfig.ICEServers))
+	for _, server := range serverConfig.ICEServers {
 		iceServer := ICEServer{
-			URLs: []string{stun_server_url},
+			URLs:     server.URLs,
+			Username: server.Username,
 		}
-		stun_server_username := os.Getenv("STUN_SERVER_USERNAME")
-		if stun_server_username != "" {
-			iceServer.Username = stun_server_username
-		}
-		stun_server_password := os.Getenv("STUN_SERVER_PASSWORD")
-		if stun_server_password != "" {
-			iceServer.Credential = stun_server_password
+		if server.Secret != "" {
+			credentials := auth.IssueTurnCredentials(server.Secret, userId, serverConfig.GetTurnCredentialTTL())
+			iceServer.Username = credentials.Username
+			iceServer.Credential = credentials.Password
+			iceServer.CredentialType = "password"
+			iceServer.ExpiresAt = credentials.ExpiresAt.Unix()
+		} else if server.Credential != "" {
+			iceServer.Credential = server.Credential
 			iceServer.CredentialType = "password"
 		}
 		iceServers = append(iceServers, iceServer)
 	}
+	return iceServers
+}
 
-	direct_connect, hasEnv := os.LookupEnv("DIRECT_CONNECT")
-	if !hasEnv {
-		panic("DIRECT_CONNECT not set")
-	}
-	direct_connect_bool, err := strconv.ParseBool(direct_connect)
-	if err != nil {
-		panic(err)
-	}
-
+// GetRtcConfig returns the ICE servers and the connection mode of the loaded server config
+func GetRtcConfig() Configuration {
 	return Configuration{
-		ICEServers:    iceServers,
-		DirectConnect: direct_connect_bool,
+		ICEServers:    GetIceServers(serverTurnUserId),
+		DirectConnect: config.Get().DirectConnect,
 	}
 }
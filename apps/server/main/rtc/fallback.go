@@ -0,0 +1,48 @@
+package rtc
+
+import (
+	"errors"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// the layer of the H264 video track published besides the vp9/av1 video, for the viewers not supporting the codec
+const FallbackLayer = "fallback"
+
+// fallbackTrack is bound as the track of the stream's codec, or as the fallback track
+// if the viewer didn't offer the codec
+type fallbackTrack struct {
+	webrtc.TrackLocal
+	fallback webrtc.TrackLocal
+	// called with the track that is bound, before binding the fallback track
+	onBind      func(useFallback bool)
+	useFallback bool
+}
+
+func (track *fallbackTrack) Bind(trackContext webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := track.TrackLocal.Bind(trackContext)
+	if err == nil {
+		track.onBind(false)
+	}
+	if !errors.Is(err, webrtc.ErrUnsupportedCodec) {
+		return codec, err
+	}
+	track.useFallback = true
+	track.onBind(true)
+	return track.fallback.Bind(trackContext)
+}
+
+// both tracks retransmit with the SSRC signaled for the viewer's track
+func (track *fallbackTrack) rtxSSRC() webrtc.SSRC {
+	if rtx, ok := track.TrackLocal.(rtxTrack); ok {
+		return rtx.rtxSSRC()
+	}
+	return 0
+}
+
+func (track *fallbackTrack) Unbind(trackContext webrtc.TrackLocalContext) error {
+	if track.useFallback {
+		return track.fallback.Unbind(trackContext)
+	}
+	return track.TrackLocal.Unbind(trackContext)
+}
@@ -0,0 +1,459 @@
+package rtc
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"signaling/main/metrics"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// the keyframe requests of the viewers are coalesced, at most one PLI is sent to the publisher in this interval
+	keyframeRequestInterval = time.Second
+	// the packets of the cached GOP, a longer GOP isn't cached
+	gopCacheLimit = 2048
+	// the recent video packets kept for the NACKs of the viewers, a power of 2 to survive the sequence number wraparound
+	packetHistorySize = 1024
+	// a lost packet is requested from the publisher once in this interval, for all the viewers
+	nackForwardInterval = 100 * time.Millisecond
+)
+
+type rtpWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// keeps the sequence numbers and timestamps of a viewer's track continuous,
+// when the packets of the track come from a different source
+type rtpRewriter struct {
+	started   bool
+	resync    bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTs    uint32
+	// the first sequence number written with the current offsets
+	syncSeq uint16
+}
+
+func (rewriter *rtpRewriter) rewrite(header *rtp.Header) {
+	if rewriter.resync {
+		// continue right after the last written packet
+		rewriter.seqOffset = rewriter.lastSeq + 1 - header.SequenceNumber
+		rewriter.tsOffset = rewriter.lastTs + 1 - header.Timestamp
+	}
+	header.SequenceNumber += rewriter.seqOffset
+	header.Timestamp += rewriter.tsOffset
+	if rewriter.resync || !rewriter.started {
+		rewriter.syncSeq = header.SequenceNumber
+		rewriter.resync = false
+	}
+	rewriter.started = true
+	rewriter.lastSeq = header.SequenceNumber
+	rewriter.lastTs = header.Timestamp
+}
+
+// the next packet comes from a different source
+func (rewriter *rtpRewriter) Resync() {
+	rewriter.resync = rewriter.started
+}
+
+// returns the sequence number of the source for a written sequence number,
+// false if the packet was written before the last resync, from another source
+func (rewriter *rtpRewriter) sourceSeq(seq uint16) (uint16, bool) {
+	if !rewriter.started || rewriter.resync {
+		return 0, false
+	}
+	if int16(seq-rewriter.syncSeq) < 0 {
+		return 0, false
+	}
+	return seq - rewriter.seqOffset, true
+}
+
+type downTrack struct {
+	writer   rtpWriter
+	rewriter *rtpRewriter
+	// the live packets are written after the cached GOP was replayed
+	isLive bool
+	// the track was moved from another layer, it continues with the next keyframe
+	waitKeyframe bool
+}
+
+// retransmits on the RTX stream of the viewer, or on the media stream if the viewer didn't negotiate RTX
+func (track *downTrack) retransmit(packet *rtp.Packet) error {
+	if writer, ok := track.writer.(rtxWriter); ok {
+		if sent, err := writer.WriteRTX(packet); sent || err != nil {
+			return err
+		}
+	}
+	return track.writer.WriteRTP(packet)
+}
+
+// the track of a viewer, the packets can be written after it's bound to the connection
+type boundTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	onBind func()
+	rtx    *rtxStream
+}
+
+func (track *boundTrack) Bind(trackContext webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := track.TrackLocalStaticRTP.Bind(trackContext)
+	if err == nil {
+		track.rtx.bind(trackContext.CodecParameters(), codec.PayloadType, trackContext.WriteStream())
+		go track.onBind()
+	}
+	return codec, err
+}
+
+func (track *boundTrack) Unbind(trackContext webrtc.TrackLocalContext) error {
+	track.rtx.unbind()
+	return track.TrackLocalStaticRTP.Unbind(trackContext)
+}
+
+func (track *boundTrack) WriteRTX(packet *rtp.Packet) (bool, error) {
+	return track.rtx.write(packet)
+}
+
+func (track *boundTrack) rtxSSRC() webrtc.SSRC {
+	return track.rtx.ssrc
+}
+
+// Forwarder writes the RTP packets of a remote track to the tracks of the viewers,
+// without depacketizing them. The SSRC and payload type are set by the TrackLocalStaticRTP
+// of every viewer, the sequence numbers and timestamps by the rewriter.
+// The packets since the last keyframe are cached, a new viewer starts with them instead of waiting for the next keyframe.
+type Forwarder struct {
+	Id       string
+	StreamId string
+	Kind     webrtc.RTPCodecType
+	Codec    webrtc.RTPCodecCapability
+	// the simulcast layer of the track
+	Layer string
+	// NewDownTrack creates the track of a viewer, the lost packets are retransmitted with the RTX SSRC if it isn't 0,
+	// onBind is called when the track is bound to the connection
+	NewDownTrack    func(viewerId string, rtxSSRC webrtc.SSRC, onBind func()) (webrtc.TrackLocal, error)
+	RemoveDownTrack func(viewerId string)
+	// StartDownTrack replays the cached GOP to the viewer, then the live packets follow
+	StartDownTrack func(viewerId string)
+	// Forward writes the packet to every viewer
+	Forward func(packet *rtp.Packet)
+	// Start reads the remote track until it ends
+	Start func(upTrack *webrtc.TrackRemote)
+	// RequestKeyframe sends a PLI to the publisher, rate limited across the viewers
+	RequestKeyframe func()
+	// HandleNack retransmits the lost packets to the viewer only, on the RTX stream if the viewer negotiated RTX,
+	// the packets missing from the history are requested from the publisher
+	HandleNack func(viewerId string, nack *rtcp.TransportLayerNack)
+	// GetBitrate returns the bitrate of the remote track, measured every second
+	GetBitrate func() float64
+
+	addDownTrack    func(viewerId string, writer rtpWriter)
+	detachDownTrack func(viewerId string) *downTrack
+	attachDownTrack func(viewerId string, track *downTrack)
+}
+
+func newForwarder(
+	streamId string,
+	id string,
+	layer string,
+	kind webrtc.RTPCodecType,
+	codec webrtc.RTPCodecCapability,
+	sendPLI func() error,
+	sendNack func(sequenceNumbers []uint16) error,
+) *Forwarder {
+	downTracks := make(map[string]*downTrack)
+	// guards the cached GOP too, the replay and the live packets can't interleave
+	downTracksMutex := sync.Mutex{}
+
+	// the packets since the last keyframe, only for video
+	gop := make([]*rtp.Packet, 0)
+	gopTimestamp := uint32(0)
+	isGopCached := false
+	// indexed by the sequence numbers of the publisher
+	history := make([]*rtp.Packet, packetHistorySize)
+	nackedAt := make([]time.Time, packetHistorySize)
+
+	// returns true for the first packet of a keyframe
+	cachePacket := func(packet *rtp.Packet) bool {
+		// the SPS and the IDR of H264 are in different packets of the same frame
+		isKeyframeStart := isKeyframe(codec.MimeType, packet.Payload) && (!isGopCached || packet.Timestamp != gopTimestamp)
+		if isKeyframeStart {
+			gop = gop[:0]
+			gopTimestamp = packet.Timestamp
+			isGopCached = true
+		}
+		if !isGopCached {
+			return false
+		}
+		if len(gop) >= gopCacheLimit {
+			gop = gop[:0]
+			isGopCached = false
+			return false
+		}
+		gop = append(gop, packet)
+		return isKeyframeStart
+	}
+
+	keyframeMutex := sync.Mutex{}
+	lastKeyframeRequest := time.Time{}
+	keyframeRequestPending := false
+	writePLI := func() {
+		if err := sendPLI(); err != nil {
+			log.Err(err).
+				Str("streamId", streamId).
+				Msg("failed to send PLI")
+			return
+		}
+		metrics.PLIsSent.Inc(streamId)
+	}
+
+	forwardedBytes := metrics.ForwardedRtpBytes.With(streamId, id, kind.String())
+	forwardedPackets := metrics.ForwardedRtpPackets.With(streamId, id, kind.String())
+
+	bitrate := float64(0)
+	bitrateWindowStart := time.Now()
+	bitrateWindowBytes := 0
+
+	forwarder := &Forwarder{
+		Id:       id,
+		StreamId: streamId,
+		Kind:     kind,
+		Codec:    codec,
+		Layer:    layer,
+	}
+
+	forwarder.addDownTrack = func(viewerId string, writer rtpWriter) {
+		downTracksMutex.Lock()
+		defer downTracksMutex.Unlock()
+		downTracks[viewerId] = &downTrack{
+			writer:   writer,
+			rewriter: &rtpRewriter{},
+		}
+	}
+
+	forwarder.NewDownTrack = func(viewerId string, rtxSSRC webrtc.SSRC, onBind func()) (webrtc.TrackLocal, error) {
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, id, "proxy")
+		if err != nil {
+			return nil, err
+		}
+		bound := &boundTrack{TrackLocalStaticRTP: track, onBind: onBind, rtx: newRTXStream(rtxSSRC)}
+		forwarder.addDownTrack(viewerId, bound)
+		return bound, nil
+	}
+
+	forwarder.RemoveDownTrack = func(viewerId string) {
+		downTracksMutex.Lock()
+		defer downTracksMutex.Unlock()
+		delete(downTracks, viewerId)
+	}
+
+	forwarder.detachDownTrack = func(viewerId string) *downTrack {
+		downTracksMutex.Lock()
+		defer downTracksMutex.Unlock()
+		track, ok := downTracks[viewerId]
+		if !ok {
+			return nil
+		}
+		delete(downTracks, viewerId)
+		return track
+	}
+
+	forwarder.attachDownTrack = func(viewerId string, track *downTrack) {
+		downTracksMutex.Lock()
+		defer downTracksMutex.Unlock()
+		track.rewriter.Resync()
+		track.waitKeyframe = true
+		downTracks[viewerId] = track
+	}
+
+	forwarder.GetBitrate = func() float64 {
+		downTracksMutex.Lock()
+		defer downTracksMutex.Unlock()
+		return bitrate
+	}
+
+	writePacket := func(viewerId string, track *downTrack, packet *rtp.Packet) {
+		// the header is rewritten per viewer, the payload is shared
+		out := *packet
+		track.rewriter.rewrite(&out.Header)
+		if err := track.writer.WriteRTP(&out); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Err(err).
+				Str("streamId", streamId).
+				Str("viewerId", viewerId).
+				Msg("failed to forward rtp packet")
+		}
+	}
+
+	forwarder.StartDownTrack = func(viewerId string) {
+		downTracksMutex.Lock()
+		track, ok := downTracks[viewerId]
+		if !ok || track.isLive {
+			downTracksMutex.Unlock()
+			return
+		}
+		for _, packet := range gop {
+			writePacket(viewerId, track, packet)
+		}
+		track.isLive = true
+		hasKeyframe := isGopCached
+		downTracksMutex.Unlock()
+
+		if !hasKeyframe {
+			// the viewer can only decode from a keyframe
+			forwarder.RequestKeyframe()
+		}
+	}
+
+	forwarder.Forward = func(packet *rtp.Packet) {
+		forwardedBytes.Add(float64(packet.MarshalSize()))
+		forwardedPackets.Add(1)
+
+		downTracksMutex.Lock()
+		defer downTracksMutex.Unlock()
+		bitrateWindowBytes += packet.MarshalSize()
+		if elapsed := time.Since(bitrateWindowStart); elapsed >= time.Second {
+			bitrate = float64(bitrateWindowBytes*8) / elapsed.Seconds()
+			bitrateWindowStart = time.Now()
+			bitrateWindowBytes = 0
+		}
+
+		isKeyframeStart := false
+		if kind == webrtc.RTPCodecTypeVideo {
+			// the packet is reused by the reader of the remote track
+			clone := packet.Clone()
+			history[clone.SequenceNumber%packetHistorySize] = clone
+			isKeyframeStart = cachePacket(clone)
+		}
+		for viewerId, track := range downTracks {
+			if !track.isLive {
+				continue
+			}
+			if track.waitKeyframe {
+				if !isKeyframeStart {
+					continue
+				}
+				track.waitKeyframe = false
+			}
+			writePacket(viewerId, track, packet)
+		}
+	}
+
+	forwarder.HandleNack = func(viewerId string, nack *rtcp.TransportLayerNack) {
+		if kind != webrtc.RTPCodecTypeVideo {
+			return
+		}
+		missing := make([]uint16, 0)
+		retransmitted := 0
+
+		downTracksMutex.Lock()
+		track, ok := downTracks[viewerId]
+		if !ok || !track.isLive {
+			downTracksMutex.Unlock()
+			return
+		}
+		for _, pair := range nack.Nacks {
+			for _, seq := range pair.PacketList() {
+				// the sequence number of the publisher, the packets of the previous layer aren't in the history
+				upSeq, ok := track.rewriter.sourceSeq(seq)
+				if !ok {
+					continue
+				}
+				packet := history[upSeq%packetHistorySize]
+				if packet == nil || packet.SequenceNumber != upSeq {
+					if time.Since(nackedAt[upSeq%packetHistorySize]) >= nackForwardInterval {
+						nackedAt[upSeq%packetHistorySize] = time.Now()
+						missing = append(missing, upSeq)
+					}
+					continue
+				}
+				// written with the rewritten header, without moving the rewriter
+				out := *packet
+				out.SequenceNumber = seq
+				out.Timestamp = packet.Timestamp + track.rewriter.tsOffset
+				if err := track.retransmit(&out); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+					log.Err(err).
+						Str("streamId", streamId).
+						Str("viewerId", viewerId).
+						Msg("failed to retransmit rtp packet")
+					continue
+				}
+				retransmitted++
+			}
+		}
+		downTracksMutex.Unlock()
+
+		if retransmitted > 0 {
+			metrics.RetransmittedRtpPackets.Add(float64(retransmitted), streamId)
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if err := sendNack(missing); err != nil {
+			log.Err(err).
+				Str("streamId", streamId).
+				Msg("failed to send NACK")
+			return
+		}
+		metrics.NacksForwarded.Add(float64(len(missing)), streamId)
+	}
+
+	forwarder.RequestKeyframe = func() {
+		if kind != webrtc.RTPCodecTypeVideo {
+			return
+		}
+		keyframeMutex.Lock()
+		if keyframeRequestPending {
+			keyframeMutex.Unlock()
+			return
+		}
+		wait := keyframeRequestInterval - time.Since(lastKeyframeRequest)
+		if wait <= 0 {
+			lastKeyframeRequest = time.Now()
+			keyframeMutex.Unlock()
+			writePLI()
+			return
+		}
+		// send one PLI for all the requests of the interval
+		keyframeRequestPending = true
+		keyframeMutex.Unlock()
+		time.AfterFunc(wait, func() {
+			keyframeMutex.Lock()
+			keyframeRequestPending = false
+			lastKeyframeRequest = time.Now()
+			keyframeMutex.Unlock()
+			writePLI()
+		})
+	}
+
+	forwarder.Start = func(upTrack *webrtc.TrackRemote) {
+		buf := make([]byte, 1500)
+		packet := &rtp.Packet{}
+		for {
+			n, _, err := upTrack.Read(buf)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					log.Err(err).
+						Str("streamId", streamId).
+						Str("trackId", id).
+						Msg("failed to read the remote track")
+				}
+				return
+			}
+			if err := packet.Unmarshal(buf[:n]); err != nil {
+				log.Err(err).
+					Str("streamId", streamId).
+					Msg("invalid rtp packet")
+				continue
+			}
+			forwarder.Forward(packet)
+		}
+	}
+
+	return forwarder
+}
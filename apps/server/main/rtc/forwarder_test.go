@@ -0,0 +1,544 @@
+package rtc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// the packets of a 1080p VP8 stream, 5 packets per frame at 30 fps
+const (
+	benchPacketsPerFrame = 5
+	benchPayloadSize     = 1100
+	benchFrameDuration   = 90000 / 30
+)
+
+type discardWriter struct {
+	packets int
+}
+
+func (writer *discardWriter) WriteRTP(packet *rtp.Packet) error {
+	writer.packets++
+	return nil
+}
+
+// counts the packets pushed after a packet until it's written, the sequence numbers of the packets are their indices
+type delayWriter struct {
+	pushed  int
+	packets int
+	delay   int
+}
+
+func (writer *delayWriter) WriteRTP(packet *rtp.Packet) error {
+	writer.delay += (writer.pushed - int(packet.SequenceNumber) + writer.packets) % writer.packets
+	return nil
+}
+
+func newBenchPackets(frames int) []*rtp.Packet {
+	packets := make([]*rtp.Packet, 0, frames*benchPacketsPerFrame)
+	seq := uint16(0)
+	for frame := 0; frame < frames; frame++ {
+		for i := 0; i < benchPacketsPerFrame; i++ {
+			payload := make([]byte, benchPayloadSize)
+			// VP8 payload descriptor, the S bit marks the first packet of the frame
+			if i == 0 {
+				payload[0] = 0x10
+			}
+			packets = append(packets, &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    96,
+					SequenceNumber: seq,
+					Timestamp:      uint32(frame * benchFrameDuration),
+					SSRC:           1234,
+					Marker:         i == benchPacketsPerFrame-1,
+				},
+				Payload: payload,
+			})
+			seq++
+		}
+	}
+	return packets
+}
+
+// the previous path: depacketize with the samplebuilder and packetize again like TrackLocalStaticSample
+func BenchmarkSampleBuilderPath(b *testing.B) {
+	packets := newBenchPackets(300)
+	writer := &discardWriter{}
+	sb := samplebuilder.New(1000, &codecs.VP8Packet{}, 90000)
+	packetizer := rtp.NewPacketizer(1200, 96, 1234, &codecs.VP8Payloader{}, rtp.NewRandomSequencer(), 90000)
+
+	// the indices of the packets waiting in the samplebuilder
+	pushed := make([]int, 0, 64)
+	// the number of packets pushed after a packet, until its frame is written
+	delay := 0
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := packets[i%len(packets)]
+		// the packets repeat, keep the sequence numbers increasing
+		out := *packet
+		out.SequenceNumber = uint16(i)
+		out.Timestamp = uint32(i/benchPacketsPerFrame) * benchFrameDuration
+		sb.Push(&out)
+		pushed = append(pushed, i)
+		for sample := sb.Pop(); sample != nil; sample = sb.Pop() {
+			for _, p := range packetizer.Packetize(sample.Data, uint32(sample.Duration.Seconds()*90000)) {
+				writer.WriteRTP(p)
+			}
+			// the frame is complete when the first packet of the next frame arrives
+			for _, at := range pushed[:len(pushed)-1] {
+				delay += i - at
+			}
+			pushed = append(pushed[:0], pushed[len(pushed)-1])
+		}
+	}
+	b.ReportMetric(float64(delay)/float64(b.N), "delay-packets/op")
+}
+
+// the RTP forwarder, writing the packets without depacketizing them
+func BenchmarkForwarderPath(b *testing.B) {
+	packets := newBenchPackets(300)
+	writer := &delayWriter{packets: len(packets)}
+	forwarder := newForwarder("bench", "video", "f", webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, func() error { return nil }, func([]uint16) error { return nil })
+	forwarder.addDownTrack("viewer", writer)
+	forwarder.StartDownTrack("viewer")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer.pushed = i % len(packets)
+		forwarder.Forward(packets[i%len(packets)])
+	}
+	b.ReportMetric(float64(writer.delay)/float64(b.N), "delay-packets/op")
+}
+
+type recordWriter struct {
+	packets []rtp.Packet
+}
+
+func (writer *recordWriter) WriteRTP(packet *rtp.Packet) error {
+	writer.packets = append(writer.packets, *packet)
+	return nil
+}
+
+func (writer *recordWriter) sequenceNumbers() []uint16 {
+	sequenceNumbers := make([]uint16, 0, len(writer.packets))
+	for _, packet := range writer.packets {
+		sequenceNumbers = append(sequenceNumbers, packet.SequenceNumber)
+	}
+	return sequenceNumbers
+}
+
+// a viewer's track which negotiated RTX or not
+type rtxRecordWriter struct {
+	recordWriter
+	negotiated    bool
+	retransmitted []rtp.Packet
+}
+
+func (writer *rtxRecordWriter) WriteRTX(packet *rtp.Packet) (bool, error) {
+	if !writer.negotiated {
+		return false, nil
+	}
+	writer.retransmitted = append(writer.retransmitted, *packet)
+	return true, nil
+}
+
+// a VP8 packet, the first packet of a keyframe or a packet in the middle of a frame
+func newVP8Packet(seq uint16, timestamp uint32, keyframe bool) *rtp.Packet {
+	payload := []byte{0x00, 0x01, 0x00}
+	if keyframe {
+		payload = []byte{0x10, 0x00, 0x00}
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    96,
+			SequenceNumber: seq,
+			Timestamp:      timestamp,
+			SSRC:           1234,
+		},
+		Payload: payload,
+	}
+}
+
+// a VP8 forwarder recording the NACKs sent to the publisher
+func newTestForwarder(layer string, nacked *[]uint16) *Forwarder {
+	return newForwarder("stream", "video_"+layer, layer, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		func() error { return nil },
+		func(sequenceNumbers []uint16) error {
+			*nacked = append(*nacked, sequenceNumbers...)
+			return nil
+		},
+	)
+}
+
+func nackOf(sequenceNumbers ...uint16) *rtcp.TransportLayerNack {
+	return &rtcp.TransportLayerNack{Nacks: rtcp.NackPairsFromSequenceNumbers(sequenceNumbers)}
+}
+
+func TestHandleNack(t *testing.T) {
+	tests := []struct {
+		name string
+		// the forwarded sequence numbers of the publisher
+		forwarded         []uint16
+		nack              []uint16
+		wantRetransmitted []uint16
+		wantNacked        []uint16
+	}{
+		{
+			name:              "in the history",
+			forwarded:         []uint16{100, 101, 102, 103},
+			nack:              []uint16{101, 102},
+			wantRetransmitted: []uint16{101, 102},
+			wantNacked:        []uint16{},
+		},
+		{
+			name:              "lost by the publisher",
+			forwarded:         []uint16{100, 101, 103},
+			nack:              []uint16{102},
+			wantRetransmitted: []uint16{},
+			wantNacked:        []uint16{102},
+		},
+		{
+			name:              "partly in the history",
+			forwarded:         []uint16{100, 102, 103},
+			nack:              []uint16{101, 102},
+			wantRetransmitted: []uint16{102},
+			wantNacked:        []uint16{101},
+		},
+		{
+			name:              "across the wraparound",
+			forwarded:         []uint16{65534, 65535, 0, 1},
+			nack:              []uint16{65535, 0},
+			wantRetransmitted: []uint16{65535, 0},
+			wantNacked:        []uint16{},
+		},
+		{
+			name:              "overwritten in the history",
+			forwarded:         []uint16{100, 101, 100 + packetHistorySize},
+			nack:              []uint16{100},
+			wantRetransmitted: []uint16{},
+			wantNacked:        []uint16{100},
+		},
+		{
+			name:              "before the viewer joined",
+			forwarded:         []uint16{100, 101},
+			nack:              []uint16{99},
+			wantRetransmitted: []uint16{},
+			wantNacked:        []uint16{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nacked := []uint16{}
+			forwarder := newTestForwarder("f", &nacked)
+			writer := &recordWriter{}
+			forwarder.addDownTrack("viewer", writer)
+			forwarder.StartDownTrack("viewer")
+			for i, seq := range test.forwarded {
+				forwarder.Forward(newVP8Packet(seq, 3000, i == 0))
+			}
+			writer.packets = nil
+
+			forwarder.HandleNack("viewer", nackOf(test.nack...))
+			if got := writer.sequenceNumbers(); !reflect.DeepEqual(got, test.wantRetransmitted) {
+				t.Errorf("retransmitted %v, want %v", got, test.wantRetransmitted)
+			}
+			if !reflect.DeepEqual(nacked, test.wantNacked) {
+				t.Errorf("nacked %v to the publisher, want %v", nacked, test.wantNacked)
+			}
+		})
+	}
+}
+
+func TestHandleNackRTX(t *testing.T) {
+	for _, negotiated := range []bool{true, false} {
+		nacked := []uint16{}
+		forwarder := newTestForwarder("f", &nacked)
+		writer := &rtxRecordWriter{negotiated: negotiated}
+		forwarder.addDownTrack("viewer", writer)
+		forwarder.StartDownTrack("viewer")
+		for seq := uint16(100); seq < 104; seq++ {
+			forwarder.Forward(newVP8Packet(seq, 3000, seq == 100))
+		}
+		written := writer.packets[1]
+		writer.packets = nil
+
+		forwarder.HandleNack("viewer", nackOf(101))
+		retransmitted, other := writer.retransmitted, writer.packets
+		if !negotiated {
+			retransmitted, other = writer.packets, writer.retransmitted
+		}
+		if len(retransmitted) != 1 || !reflect.DeepEqual(retransmitted[0], written) {
+			t.Errorf("RTX negotiated %v: retransmitted %v, want the packet written as 101", negotiated, retransmitted)
+		}
+		if len(other) != 0 {
+			t.Errorf("RTX negotiated %v: retransmitted on both streams", negotiated)
+		}
+	}
+}
+
+func TestHandleNackAfterLayerSwitch(t *testing.T) {
+	nacked := []uint16{}
+	from := newTestForwarder("f", &nacked)
+	to := newTestForwarder("h", &nacked)
+	writer := &recordWriter{}
+	from.addDownTrack("viewer", writer)
+	from.StartDownTrack("viewer")
+	for seq := uint16(1000); seq < 1005; seq++ {
+		from.Forward(newVP8Packet(seq, 3000, seq == 1000))
+	}
+	to.attachDownTrack("viewer", from.detachDownTrack("viewer"))
+	for seq := uint16(500); seq < 505; seq++ {
+		to.Forward(newVP8Packet(seq, 9000, seq == 500))
+	}
+	// 1000-1004 from the first layer, 1005-1009 from the second one
+	if got := writer.sequenceNumbers(); got[len(got)-1] != 1009 {
+		t.Fatalf("wrote %v, want continuous sequence numbers", got)
+	}
+	written := writer.packets[6]
+	writer.packets = nil
+
+	to.HandleNack("viewer", nackOf(1003, 1006))
+	if len(writer.packets) != 1 {
+		t.Fatalf("retransmitted %v, want 1006 only", writer.sequenceNumbers())
+	}
+	if packet := writer.packets[0]; !reflect.DeepEqual(packet, written) {
+		t.Errorf("retransmitted %+v, want the packet written as 1006 %+v", packet.Header, written.Header)
+	}
+	// the packets of the first layer aren't requested from the publisher of the second one
+	if len(nacked) != 0 {
+		t.Errorf("nacked %v to the publisher, want nothing", nacked)
+	}
+}
+
+func TestNackForwardInterval(t *testing.T) {
+	nacked := []uint16{}
+	forwarder := newTestForwarder("f", &nacked)
+	for _, viewerId := range []string{"viewer1", "viewer2"} {
+		forwarder.addDownTrack(viewerId, &recordWriter{})
+		forwarder.StartDownTrack(viewerId)
+	}
+	forwarder.Forward(newVP8Packet(100, 3000, true))
+	forwarder.Forward(newVP8Packet(102, 3000, false))
+
+	forwarder.HandleNack("viewer1", nackOf(101))
+	forwarder.HandleNack("viewer2", nackOf(101))
+	if !reflect.DeepEqual(nacked, []uint16{101}) {
+		t.Fatalf("nacked %v to the publisher, want 101 once for both viewers", nacked)
+	}
+
+	time.Sleep(nackForwardInterval)
+	forwarder.HandleNack("viewer1", nackOf(101))
+	if !reflect.DeepEqual(nacked, []uint16{101, 101}) {
+		t.Errorf("nacked %v to the publisher, want 101 again after the interval", nacked)
+	}
+}
+
+func TestRTPRewriter(t *testing.T) {
+	type step struct {
+		// the next packet comes from another source
+		resync  bool
+		seq     uint16
+		ts      uint32
+		wantSeq uint16
+		wantTs  uint32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "unchanged without resync",
+			steps: []step{
+				{seq: 100, ts: 3000, wantSeq: 100, wantTs: 3000},
+				{seq: 101, ts: 6000, wantSeq: 101, wantTs: 6000},
+			},
+		},
+		{
+			name: "resync before the first packet",
+			steps: []step{
+				{resync: true, seq: 100, ts: 3000, wantSeq: 100, wantTs: 3000},
+			},
+		},
+		{
+			name: "wraparound of the source",
+			steps: []step{
+				{seq: 65535, ts: 0xFFFFFFFF, wantSeq: 65535, wantTs: 0xFFFFFFFF},
+				{seq: 0, ts: 2999, wantSeq: 0, wantTs: 2999},
+			},
+		},
+		{
+			name: "resync continues after the last packet",
+			steps: []step{
+				{seq: 100, ts: 3000, wantSeq: 100, wantTs: 3000},
+				{resync: true, seq: 5000, ts: 90000, wantSeq: 101, wantTs: 3001},
+				{seq: 5001, ts: 93000, wantSeq: 102, wantTs: 6001},
+			},
+		},
+		{
+			name: "resync across the wraparound",
+			steps: []step{
+				{seq: 65535, ts: 0xFFFFFFFF, wantSeq: 65535, wantTs: 0xFFFFFFFF},
+				{resync: true, seq: 10, ts: 90000, wantSeq: 0, wantTs: 0},
+				{seq: 11, ts: 93000, wantSeq: 1, wantTs: 3000},
+			},
+		},
+		{
+			name: "wraparound of the new source",
+			steps: []step{
+				{seq: 100, ts: 3000, wantSeq: 100, wantTs: 3000},
+				{resync: true, seq: 65535, ts: 0xFFFFFFFF, wantSeq: 101, wantTs: 3001},
+				{seq: 0, ts: 2999, wantSeq: 102, wantTs: 6001},
+			},
+		},
+		{
+			name: "resync twice",
+			steps: []step{
+				{seq: 100, ts: 3000, wantSeq: 100, wantTs: 3000},
+				{resync: true, seq: 5000, ts: 90000, wantSeq: 101, wantTs: 3001},
+				{resync: true, seq: 200, ts: 6000, wantSeq: 102, wantTs: 3002},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewriter := &rtpRewriter{}
+			for i, step := range test.steps {
+				if step.resync {
+					rewriter.Resync()
+				}
+				header := &rtp.Header{SequenceNumber: step.seq, Timestamp: step.ts}
+				rewriter.rewrite(header)
+				if header.SequenceNumber != step.wantSeq || header.Timestamp != step.wantTs {
+					t.Errorf("packet %d: got seq %d ts %d, want seq %d ts %d", i, header.SequenceNumber, header.Timestamp, step.wantSeq, step.wantTs)
+				}
+				if seq, ok := rewriter.sourceSeq(header.SequenceNumber); !ok || seq != step.seq {
+					t.Errorf("packet %d: source seq %d %v, want %d", i, seq, ok, step.seq)
+				}
+			}
+		})
+	}
+}
+
+func TestRTPRewriterSourceSeq(t *testing.T) {
+	rewriter := &rtpRewriter{}
+	if _, ok := rewriter.sourceSeq(100); ok {
+		t.Error("source seq before the first packet")
+	}
+	rewriter.rewrite(&rtp.Header{SequenceNumber: 100})
+	rewriter.rewrite(&rtp.Header{SequenceNumber: 101})
+	rewriter.Resync()
+	if _, ok := rewriter.sourceSeq(101); ok {
+		t.Error("source seq while the resync is pending")
+	}
+	rewriter.rewrite(&rtp.Header{SequenceNumber: 5000})
+	if _, ok := rewriter.sourceSeq(101); ok {
+		t.Error("source seq of a packet of the previous source")
+	}
+	if seq, ok := rewriter.sourceSeq(102); !ok || seq != 5000 {
+		t.Errorf("got source seq %d %v, want 5000", seq, ok)
+	}
+}
+
+func TestGopReplay(t *testing.T) {
+	overLimit := []*rtp.Packet{newVP8Packet(0, 3000, true)}
+	for seq := uint16(1); seq <= gopCacheLimit; seq++ {
+		overLimit = append(overLimit, newVP8Packet(seq, 3000*uint32(seq/10+1), false))
+	}
+	tests := []struct {
+		name         string
+		forwarded    []*rtp.Packet
+		wantReplayed []uint16
+		wantPLI      bool
+	}{
+		{
+			name: "since the keyframe",
+			forwarded: []*rtp.Packet{
+				newVP8Packet(100, 3000, false),
+				newVP8Packet(101, 6000, true),
+				newVP8Packet(102, 6000, false),
+				newVP8Packet(103, 9000, false),
+			},
+			wantReplayed: []uint16{101, 102, 103, 2000},
+		},
+		{
+			name: "since the last keyframe",
+			forwarded: []*rtp.Packet{
+				newVP8Packet(100, 3000, true),
+				newVP8Packet(101, 6000, false),
+				newVP8Packet(102, 9000, true),
+				newVP8Packet(103, 12000, false),
+			},
+			wantReplayed: []uint16{102, 103, 2000},
+		},
+		{
+			name: "keyframe packets of the same frame",
+			forwarded: []*rtp.Packet{
+				newVP8Packet(100, 3000, true),
+				newVP8Packet(101, 3000, true),
+				newVP8Packet(102, 6000, false),
+			},
+			wantReplayed: []uint16{100, 101, 102, 2000},
+		},
+		{
+			name: "without a keyframe",
+			forwarded: []*rtp.Packet{
+				newVP8Packet(100, 3000, false),
+				newVP8Packet(101, 6000, false),
+			},
+			wantReplayed: []uint16{},
+			wantPLI:      true,
+		},
+		{
+			name:         "over the cache limit",
+			forwarded:    overLimit,
+			wantReplayed: []uint16{},
+			wantPLI:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plis := 0
+			forwarder := newForwarder("stream", "video", "f", webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+				func() error {
+					plis++
+					return nil
+				},
+				func([]uint16) error { return nil },
+			)
+			for _, packet := range test.forwarded {
+				forwarder.Forward(packet)
+			}
+
+			writer := &recordWriter{}
+			forwarder.addDownTrack("viewer", writer)
+			// the track isn't bound yet, the packet is only replayed with the cached GOP
+			forwarder.Forward(newVP8Packet(2000, 90000, false))
+			forwarder.StartDownTrack("viewer")
+			if got := writer.sequenceNumbers(); !reflect.DeepEqual(got, test.wantReplayed) {
+				t.Errorf("replayed %v, want %v", got, test.wantReplayed)
+			}
+			if (plis > 0) != test.wantPLI {
+				t.Errorf("sent %d PLIs, want a PLI %v", plis, test.wantPLI)
+			}
+
+			// started once, the live packets follow
+			forwarder.StartDownTrack("viewer")
+			writer.packets = nil
+			forwarder.Forward(newVP8Packet(2001, 93000, false))
+			if got := writer.sequenceNumbers(); !reflect.DeepEqual(got, []uint16{2001}) {
+				t.Errorf("wrote %v after the replay, want the live packet 2001", got)
+			}
+		})
+	}
+}
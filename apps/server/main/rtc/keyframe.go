@@ -0,0 +1,184 @@
+package rtc
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	h264NaluIDR   = 5
+	h264NaluSPS   = 7
+	h264NaluStapA = 24
+	h264NaluFuA   = 28
+
+	av1ObuSequenceHeader = 1
+)
+
+// isKeyframe reports whether the RTP payload contains the start of a keyframe
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+	return false
+}
+
+func isH264KeyframeNalu(naluType byte) bool {
+	return naluType == h264NaluIDR || naluType == h264NaluSPS
+}
+
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	naluType := payload[0] & 0x1F
+	switch naluType {
+	case h264NaluStapA:
+		// 2 bytes size before every aggregated NAL unit
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if isH264KeyframeNalu(payload[offset] & 0x1F) {
+				return true
+			}
+			offset += size
+		}
+		return false
+	case h264NaluFuA:
+		// only the first fragment starts the keyframe
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isH264KeyframeNalu(payload[1]&0x1F)
+	}
+	return isH264KeyframeNalu(naluType)
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7741#section-4.2
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// the start of partition 0
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) <= offset {
+			return false
+		}
+		extension := payload[offset]
+		offset++
+		if extension&0x80 != 0 {
+			// 7 or 15 bits picture id
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		if extension&0x40 != 0 {
+			offset++
+		}
+		if extension&0x30 != 0 {
+			offset++
+		}
+	}
+	if len(payload) <= offset {
+		return false
+	}
+	// the inverse key frame flag of the VP8 payload header
+	return payload[offset]&0x01 == 0
+}
+
+// https://datatracker.ietf.org/doc/html/draft-ietf-payload-vp9#section-4.2
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// the start of a frame (B), which isn't inter-picture predicted (P)
+	return payload[0]&0x08 != 0 && payload[0]&0x40 == 0
+}
+
+// https://aomediacodec.github.io/av1-rtp-spec/#44-av1-aggregation-header
+func isAV1Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	// the first OBU element continues the fragment of the previous packet (Z)
+	if payload[0]&0x80 != 0 {
+		return false
+	}
+	// the first packet of a coded video sequence (N)
+	if payload[0]&0x08 != 0 {
+		return true
+	}
+	// the number of OBU elements, the last one has no length field, 0: every element has one
+	elements := int(payload[0]>>4) & 0x03
+	offset := 1
+	for element := 1; offset < len(payload); element++ {
+		end := len(payload)
+		if elements == 0 || element < elements {
+			size, n := readLEB128(payload[offset:])
+			if n == 0 {
+				return false
+			}
+			offset += n
+			if offset+int(size) < end {
+				end = offset + int(size)
+			}
+		}
+		if hasAV1SequenceHeader(payload[offset:end]) {
+			return true
+		}
+		offset = end
+	}
+	return false
+}
+
+// the encoders send a sequence header before every keyframe, the OBUs of the element may have size fields
+func hasAV1SequenceHeader(element []byte) bool {
+	for offset := 0; offset < len(element); {
+		header := element[offset]
+		if (header>>3)&0x0F == av1ObuSequenceHeader {
+			return true
+		}
+		// without a size field the OBU fills the element
+		if header&0x02 == 0 {
+			return false
+		}
+		offset++
+		// the extension header
+		if header&0x04 != 0 {
+			offset++
+		}
+		if offset >= len(element) {
+			return false
+		}
+		size, n := readLEB128(element[offset:])
+		if n == 0 {
+			return false
+		}
+		offset += n + int(size)
+	}
+	return false
+}
+
+// returns the value and its length, 0 if it's invalid
+func readLEB128(data []byte) (uint, int) {
+	value := uint(0)
+	for i := 0; i < len(data) && i < 8; i++ {
+		value |= uint(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
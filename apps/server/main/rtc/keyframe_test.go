@@ -0,0 +1,68 @@
+package rtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"h264 IDR", webrtc.MimeTypeH264, []byte{0x65, 0x88, 0x84}, true},
+		{"h264 SPS", webrtc.MimeTypeH264, []byte{0x67, 0x42, 0xe0}, true},
+		{"h264 non-IDR slice", webrtc.MimeTypeH264, []byte{0x41, 0x9a, 0x02}, false},
+		{"h264 STAP-A with SPS and PPS", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"h264 STAP-A with the IDR last", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x06, 0x00, 0x02, 0x65, 0x88}, true},
+		{"h264 STAP-A without keyframe", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"h264 truncated STAP-A", webrtc.MimeTypeH264, []byte{0x78, 0x00}, false},
+		{"h264 FU-A start of IDR", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"h264 FU-A middle of IDR", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"h264 FU-A start of non-IDR", webrtc.MimeTypeH264, []byte{0x7c, 0x81, 0x9a}, false},
+		{"h264 truncated FU-A", webrtc.MimeTypeH264, []byte{0x7c}, false},
+		{"h264 empty", webrtc.MimeTypeH264, []byte{}, false},
+
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00, 0x9d}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01, 0x9d}, false},
+		{"vp8 middle of a frame", webrtc.MimeTypeVP8, []byte{0x00, 0x00, 0x9d}, false},
+		{"vp8 other partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00, 0x9d}, false},
+		{"vp8 keyframe with 15 bits picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x00}, true},
+		{"vp8 keyframe with picture id, TL0PICIDX and TID", webrtc.MimeTypeVP8, []byte{0x90, 0xe0, 0x12, 0x34, 0x40, 0x00}, true},
+		{"vp8 interframe with picture id, TL0PICIDX and TID", webrtc.MimeTypeVP8, []byte{0x90, 0xe0, 0x12, 0x34, 0x40, 0x01}, false},
+		{"vp8 truncated extension", webrtc.MimeTypeVP8, []byte{0x90}, false},
+		{"vp8 truncated picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 without payload header", webrtc.MimeTypeVP8, []byte{0x10}, false},
+		{"vp8 empty", webrtc.MimeTypeVP8, []byte{}, false},
+
+		{"vp9 start of a keyframe", webrtc.MimeTypeVP9, []byte{0x08, 0x00}, true},
+		{"vp9 start of a keyframe with picture id", webrtc.MimeTypeVP9, []byte{0x88, 0x12, 0x00}, true},
+		{"vp9 start of an interframe", webrtc.MimeTypeVP9, []byte{0x48, 0x00}, false},
+		{"vp9 middle of a keyframe", webrtc.MimeTypeVP9, []byte{0x00, 0x00}, false},
+		{"vp9 empty", webrtc.MimeTypeVP9, []byte{}, false},
+
+		{"av1 new coded video sequence", webrtc.MimeTypeAV1, []byte{0x08, 0x00}, true},
+		{"av1 continued fragment", webrtc.MimeTypeAV1, []byte{0x88, 0x0a, 0x00}, false},
+		{"av1 sequence header", webrtc.MimeTypeAV1, []byte{0x10, 0x0a, 0x00}, true},
+		{"av1 frame", webrtc.MimeTypeAV1, []byte{0x10, 0x32, 0x00}, false},
+		{"av1 sequence header after a temporal delimiter", webrtc.MimeTypeAV1, []byte{0x10, 0x12, 0x00, 0x0a, 0x00}, true},
+		{"av1 sequence header in the element with a length field", webrtc.MimeTypeAV1, []byte{0x00, 0x02, 0x12, 0x00, 0x02, 0x0a, 0x00}, true},
+		{"av1 sequence header in the last element", webrtc.MimeTypeAV1, []byte{0x20, 0x02, 0x32, 0x00, 0x0a, 0x00}, true},
+		{"av1 frames only", webrtc.MimeTypeAV1, []byte{0x20, 0x02, 0x32, 0x00, 0x32, 0x00}, false},
+		{"av1 invalid element length", webrtc.MimeTypeAV1, []byte{0x00, 0x80}, false},
+		{"av1 truncated", webrtc.MimeTypeAV1, []byte{0x10}, false},
+
+		{"mime type case", "video/vp8", []byte{0x10, 0x00, 0x9d}, true},
+		{"audio", webrtc.MimeTypeOpus, []byte{0x10, 0x00, 0x9d}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isKeyframe(test.mimeType, test.payload); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package rtc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// a layer is selected if its bitrate fits in this share of the viewer's bandwidth estimate
+	layerBandwidthHeadroom = 0.85
+	// a higher layer is selected only if the estimate allowed it for this long
+	layerUpgradeDelay = 5 * time.Second
+	// the fraction lost (out of 256) of the viewer's receiver reports, above which a lower layer is selected
+	layerDowngradeLoss = 26
+	// the layer is selected automatically, by the bandwidth estimate of the viewer
+	LayerAuto = "auto"
+	// the video tracks a capture client can publish
+	MaxSimulcastLayers = 3
+)
+
+// the simulcast layers of the capture client, highest first: full, half and quarter resolution
+var layerOrder = []string{"f", "h", "q"}
+
+// the layer of a remote track, the RID of a simulcast track or the suffix of the track id (video_h)
+func layerOf(upTrack *webrtc.TrackRemote) string {
+	if upTrack.RID() != "" {
+		return upTrack.RID()
+	}
+	if index := strings.LastIndex(upTrack.ID(), "_"); index != -1 {
+		return upTrack.ID()[index+1:]
+	}
+	return layerOrder[0]
+}
+
+func layerIndex(layer string) int {
+	for i, l := range layerOrder {
+		if l == layer {
+			return i
+		}
+	}
+	return len(layerOrder)
+}
+
+// layerSelector moves the track of a viewer between the forwarders of the layers,
+// by the bandwidth estimate of the viewer or the layer pinned by the viewer
+type layerSelector struct {
+	viewerId string
+	// highest first
+	layers       []*Forwarder
+	current      int
+	pinned       int
+	upgradeSince time.Time
+	mutex        sync.Mutex
+}
+
+func newLayerSelector(viewerId string, forwarders []*Forwarder) *layerSelector {
+	layers := append([]*Forwarder{}, forwarders...)
+	// insertion sort, at most 3 layers
+	for i := 1; i < len(layers); i++ {
+		for j := i; j > 0 && layerIndex(layers[j].Layer) < layerIndex(layers[j-1].Layer); j-- {
+			layers[j], layers[j-1] = layers[j-1], layers[j]
+		}
+	}
+	return &layerSelector{
+		viewerId: viewerId,
+		layers:   layers,
+		pinned:   -1,
+	}
+}
+
+// Current returns the forwarder writing to the track of the viewer
+func (selector *layerSelector) Current() *Forwarder {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+	return selector.layers[selector.current]
+}
+
+// Pin selects the layer until it's unpinned with LayerAuto
+func (selector *layerSelector) Pin(layer string) {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+	if layer == LayerAuto || layer == "" {
+		selector.pinned = -1
+		return
+	}
+	for i, forwarder := range selector.layers {
+		if forwarder.Layer == layer {
+			selector.pinned = i
+			selector.switchTo(i)
+			return
+		}
+	}
+	log.Warn().
+		Str("viewerId", selector.viewerId).
+		Str("layer", layer).
+		Msg("the stream has no such layer")
+}
+
+// OnEstimate selects the highest layer fitting in the bandwidth estimate of the viewer, in bits per second
+func (selector *layerSelector) OnEstimate(bitrate float64) {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+	if selector.pinned != -1 || len(selector.layers) < 2 {
+		return
+	}
+	target := len(selector.layers) - 1
+	for i, forwarder := range selector.layers {
+		if forwarder.GetBitrate() <= bitrate*layerBandwidthHeadroom {
+			target = i
+			break
+		}
+	}
+	switch {
+	case target > selector.current:
+		selector.upgradeSince = time.Time{}
+		selector.switchTo(target)
+	case target < selector.current:
+		if selector.upgradeSince.IsZero() {
+			selector.upgradeSince = time.Now()
+		} else if time.Since(selector.upgradeSince) >= layerUpgradeDelay {
+			selector.upgradeSince = time.Time{}
+			selector.switchTo(target)
+		}
+	default:
+		selector.upgradeSince = time.Time{}
+	}
+}
+
+// OnLoss selects a lower layer if the viewer lost too many packets
+func (selector *layerSelector) OnLoss(fractionLost uint8) {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+	if selector.pinned != -1 || fractionLost < layerDowngradeLoss || selector.current == len(selector.layers)-1 {
+		return
+	}
+	selector.upgradeSince = time.Time{}
+	selector.switchTo(selector.current + 1)
+}
+
+// the track continues with the next keyframe of the layer
+func (selector *layerSelector) switchTo(index int) {
+	if index == selector.current {
+		return
+	}
+	from := selector.layers[selector.current]
+	to := selector.layers[index]
+	track := from.detachDownTrack(selector.viewerId)
+	if track == nil {
+		return
+	}
+	to.attachDownTrack(selector.viewerId, track)
+	selector.current = index
+	to.RequestKeyframe()
+
+	log.Info().
+		Str("streamId", to.StreamId).
+		Str("viewerId", selector.viewerId).
+		Str("from", from.Layer).
+		Str("to", to.Layer).
+		Msg("switched simulcast layer")
+}
+
+// the viewer didn't offer the codec of the layers, it receives the fallback track only
+func (selector *layerSelector) fallbackTo(fallback *Forwarder) {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+	selector.layers = []*Forwarder{fallback}
+	selector.current = 0
+	selector.pinned = -1
+}
+
+// RemoveDownTrack removes the track of the viewer from the current layer
+func (selector *layerSelector) RemoveDownTrack() {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+	selector.layers[selector.current].RemoveDownTrack(selector.viewerId)
+}
@@ -0,0 +1,139 @@
+package rtc
+
+import "testing"
+
+func TestLayerSelector(t *testing.T) {
+	estimate := func(bitrate float64) func(selector *layerSelector) {
+		return func(selector *layerSelector) {
+			selector.OnEstimate(bitrate)
+		}
+	}
+	// the estimate allowed the higher layer for longer than the upgrade delay
+	estimateLater := func(bitrate float64) func(selector *layerSelector) {
+		return func(selector *layerSelector) {
+			selector.OnEstimate(bitrate)
+			selector.upgradeSince = selector.upgradeSince.Add(-layerUpgradeDelay)
+			selector.OnEstimate(bitrate)
+		}
+	}
+	loss := func(fractionLost uint8) func(selector *layerSelector) {
+		return func(selector *layerSelector) {
+			selector.OnLoss(fractionLost)
+		}
+	}
+	pin := func(layer string) func(selector *layerSelector) {
+		return func(selector *layerSelector) {
+			selector.Pin(layer)
+		}
+	}
+
+	type step struct {
+		do   func(selector *layerSelector)
+		want string
+	}
+	tests := []struct {
+		name   string
+		layers []string
+		steps  []step
+	}{
+		{
+			name:   "the highest layer fitting in the estimate",
+			layers: []string{"f", "h", "q"},
+			steps: []step{
+				{estimate(4_000_000), "f"},
+				{estimate(2_000_000), "h"},
+				{estimate(100_000), "q"},
+			},
+		},
+		{
+			name:   "up after the upgrade delay",
+			layers: []string{"q", "f", "h"},
+			steps: []step{
+				{estimate(100_000), "q"},
+				{estimate(4_000_000), "q"},
+				{estimate(4_000_000), "q"},
+				{estimateLater(2_000_000), "h"},
+				{estimateLater(4_000_000), "f"},
+			},
+		},
+		{
+			name:   "a lower estimate cancels the upgrade",
+			layers: []string{"f", "h", "q"},
+			steps: []step{
+				{estimate(100_000), "q"},
+				{estimate(4_000_000), "q"},
+				{estimate(100_000), "q"},
+				{estimate(4_000_000), "q"},
+			},
+		},
+		{
+			name:   "down on loss",
+			layers: []string{"f", "h", "q"},
+			steps: []step{
+				{loss(layerDowngradeLoss - 1), "f"},
+				{loss(layerDowngradeLoss), "h"},
+				{loss(255), "q"},
+				{loss(255), "q"},
+			},
+		},
+		{
+			name:   "pinned",
+			layers: []string{"f", "h", "q"},
+			steps: []step{
+				{pin("q"), "q"},
+				{estimateLater(4_000_000), "q"},
+				{pin("h"), "h"},
+				{loss(255), "h"},
+				{pin("x"), "h"},
+				{pin(LayerAuto), "h"},
+				{estimate(100_000), "q"},
+			},
+		},
+		{
+			name:   "single layer",
+			layers: []string{"f"},
+			steps: []step{
+				{estimate(100_000), "f"},
+				{loss(255), "f"},
+			},
+		},
+	}
+	bitrates := map[string]float64{"f": 3_000_000, "h": 1_000_000, "q": 300_000}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nacked := []uint16{}
+			forwarders := make(map[string]*Forwarder)
+			layers := make([]*Forwarder, 0, len(test.layers))
+			for _, layer := range test.layers {
+				bitrate := bitrates[layer]
+				forwarder := newTestForwarder(layer, &nacked)
+				forwarder.GetBitrate = func() float64 { return bitrate }
+				forwarders[layer] = forwarder
+				layers = append(layers, forwarder)
+			}
+			selector := newLayerSelector("viewer", layers)
+			writer := &recordWriter{}
+			selector.Current().addDownTrack("viewer", writer)
+			selector.Current().StartDownTrack("viewer")
+			if selector.Current().Layer != layerOrder[0] {
+				t.Fatalf("started on %s, want the highest layer", selector.Current().Layer)
+			}
+
+			for i, step := range test.steps {
+				step.do(selector)
+				if got := selector.Current().Layer; got != step.want {
+					t.Errorf("step %d: on %s, want %s", i, got, step.want)
+				}
+			}
+
+			// the track of the viewer moved with the selected layer
+			for layer, forwarder := range forwarders {
+				writer.packets = nil
+				forwarder.Forward(newVP8Packet(100, 3000, true))
+				if written := len(writer.packets) == 1; written != (layer == selector.Current().Layer) {
+					t.Errorf("the packet of %s written %v, the current layer is %s", layer, written, selector.Current().Layer)
+				}
+			}
+		})
+	}
+}
@@ -19,7 +19,9 @@ type ConnectionManager struct {
 	*emitter.Emitter
 }
 
-func NewConnectionManager() *ConnectionManager {
+// NewConnectionManager creates the manager of the publishers or the viewers, only the viewers negotiate RTX:
+// the receivers of pion v3.1 drop the packets of an RTX stream
+func NewConnectionManager(negotiateRTX bool) *ConnectionManager {
 	//A map to store connections by their ID
 	var connections = make(map[string]*PeerConnection)
 	e := &emitter.Emitter{}
@@ -37,7 +39,7 @@ func NewConnectionManager() *ConnectionManager {
 		},
 		NewConnection: func(connectionId string) *PeerConnection {
 			log.Error().Str("connectionId", connectionId).Msg("NewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnectionNewConnection")
-			connection := newConnection(connectionId)
+			connection := newConnection(connectionId, negotiateRTX)
 
 			connections[connection.Id] = connection
 
@@ -3,14 +3,14 @@ package rtc
 import (
 	"bytes"
 	"fmt"
+	"sync"
 	"time"
 
+	"signaling/main/metrics"
+
 	"github.com/olebedev/emitter"
 	"github.com/pion/rtcp"
-	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
 	"github.com/rs/zerolog/log"
 )
 
@@ -19,6 +19,8 @@ type Signal struct {
 	Type      string                  `json:"type"`
 	Candidate webrtc.ICECandidateInit `json:"candidate"`
 	SDP       string                  `json:"sdp"`
+	// the simulcast layer pinned by the viewer, or "auto"
+	Layer string `json:"layer,omitempty"`
 }
 type Tracks struct {
 	VideoTrack *webrtc.TrackLocalStaticSample
@@ -31,13 +33,18 @@ type PeerConnection struct {
 	Signal            func(signal Signal) error
 	OnConnected       func(cb func())
 	OnDisconnected    func(cb func())
+	OnLayer           func(cb func(layer string))
 	AddTracks         func(tracks *Tracks)
 	ConnectTo         func(peerConnection *PeerConnection)
-	LocalTracks       []*webrtc.TrackLocalStaticSample
+	Forwarders        []*Forwarder
 	PendingCandidates []*webrtc.ICECandidate
 	SetSnapshot       func(snapshot *bytes.Buffer)
 	GetSnapshot       func() *bytes.Buffer
 	DataChannel       *webrtc.DataChannel
+	StreamId          string
+	Role              string
+	// the tracks of the publisher: audio and a video track for every simulcast layer
+	ExpectedTracks int
 	*webrtc.PeerConnection
 	*emitter.Emitter
 
@@ -48,9 +55,11 @@ type ICEServer struct {
 	Username       string      `json:"username,omitempty"`
 	Credential     interface{} `json:"credential,omitempty"`
 	CredentialType string      `json:"credentialType,omitempty"`
+	// unix seconds, the clients refresh the short-lived credentials before they expire
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
 }
 
-func (peerConnection *PeerConnection) initializeConnection() {
+func (peerConnection *PeerConnection) initializeConnection(negotiateRTX bool) {
 	iceServers := GetRtcConfig().ICEServers
 	parsedServers := make([]webrtc.ICEServer, len(iceServers))
 	for i, iceServer := range iceServers {
@@ -62,7 +71,7 @@ func (peerConnection *PeerConnection) initializeConnection() {
 		}
 	}
 	log.Info().Msgf("Ice servers from config: %+v", parsedServers)
-	api := SetupApi()
+	api := SetupApi(negotiateRTX)
 	_peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
 		ICEServers: parsedServers,
 	})
@@ -100,6 +109,7 @@ func (peerConnection *PeerConnection) initializeConnection() {
 	})
 
 	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
+		metrics.PeerConnectionStateTransitions.Inc(peerConnection.StreamId, peerConnection.Role, connectionState.String())
 		if connectionState == webrtc.PeerConnectionStateDisconnected {
 			peerConnection.EmitterVoid.Emit("disconnected")
 
@@ -111,10 +121,10 @@ func (peerConnection *PeerConnection) initializeConnection() {
 	})
 
 	peerConnection.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
-		localTrack := peerConnection.AddRemoteTrack(tr)
-		peerConnection.LocalTracks = append(peerConnection.LocalTracks, localTrack)
+		forwarder := peerConnection.AddRemoteTrack(tr)
+		peerConnection.Forwarders = append(peerConnection.Forwarders, forwarder)
 		go func() {
-			peerConnection.EmitterVoid.Emit("track", localTrack)
+			peerConnection.EmitterVoid.Emit("track", forwarder)
 		}()
 	})
 }
@@ -139,65 +149,234 @@ func (peerConnection *PeerConnection) applyOffer(signal Signal) (*Signal, error)
 	answerSignal := &Signal{
 		Type:     "answer",
 		ViewerId: peerConnection.Id,
-		SDP:      answer.SDP,
+		SDP:      addRTXSSRCs(answer.SDP, peerConnection.rtxSSRCs()),
 	}
 
 	return answerSignal, nil
 
 }
 
-func (peerConnection *PeerConnection) AddRemoteTrack(upTrack *webrtc.TrackRemote) *webrtc.TrackLocalStaticSample {
+// AnswerOffer answers with the gathered ICE candidates included in the SDP,
+// for WHIP/WHEP clients which don't receive trickled candidates
+func (peerConnection *PeerConnection) AnswerOffer(sdp string) (string, error) {
+	offer := webrtc.SessionDescription{SDP: sdp, Type: webrtc.SDPTypeOffer}
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return "", err
+	}
+	// a WHIP publisher may send video only or more video tracks, the tracks are waited for by the offer
+	expectedTracks, err := sendingMediaCount(offer)
+	if err != nil {
+		return "", err
+	}
+	peerConnection.ExpectedTracks = expectedTracks
 
-	go func() {
-		ticker := time.NewTicker(time.Second * 2)
-		for range ticker.C {
-			if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
-				return
-			}
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
 
-			errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(upTrack.SSRC())}})
-			if errSend != nil {
-				return
-			}
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection.PeerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gatherComplete
+
+	return addRTXSSRCs(peerConnection.LocalDescription().SDP, peerConnection.rtxSSRCs()), nil
+}
+
+// the audio and video m-lines of the description which send media (sendonly or sendrecv)
+func sendingMediaCount(description webrtc.SessionDescription) (int, error) {
+	parsed, err := description.Unmarshal()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "audio" && media.MediaName.Media != "video" {
+			continue
 		}
-	}()
+		// a rejected m-line
+		if media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute("recvonly"); ok {
+			continue
+		}
+		if _, ok := media.Attribute("inactive"); ok {
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
 
-	var depacketizer rtp.Depacketizer
-	if upTrack.Codec().RTPCodecCapability.MimeType == webrtc.MimeTypeH264 {
-		depacketizer = &codecs.H264Packet{}
-	} else if upTrack.Codec().RTPCodecCapability.MimeType == webrtc.MimeTypeVP8 {
-		depacketizer = &codecs.VP8Packet{}
-	} else if upTrack.Codec().RTPCodecCapability.MimeType == webrtc.MimeTypeOpus {
-		depacketizer = &codecs.OpusPacket{}
+// WaitForTracks waits until the connection is connected and received the audio and video tracks
+func (peerConnection *PeerConnection) WaitForTracks(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+	for range ticker.C {
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected && peerConnection.hasAllTracks() {
+			return true
+		}
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed || time.Now().After(deadline) {
+			return false
+		}
+	}
+	return false
+}
+
+func (peerConnection *PeerConnection) hasAllTracks() bool {
+	return len(peerConnection.Forwarders) == peerConnection.ExpectedTracks
+}
+
+// AddRemoteTrack starts forwarding the packets of the remote track to the viewers
+func (peerConnection *PeerConnection) AddRemoteTrack(upTrack *webrtc.TrackRemote) *Forwarder {
+
+	// the keyframes are requested only when a viewer needs one
+	sendPLI := func() error {
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return nil
+		}
+		return peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(upTrack.SSRC())}})
+	}
+
+	sendNack := func(sequenceNumbers []uint16) error {
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return nil
+		}
+		return peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.TransportLayerNack{
+			MediaSSRC: uint32(upTrack.SSRC()),
+			Nacks:     rtcp.NackPairsFromSequenceNumbers(sequenceNumbers),
+		}})
+	}
+
+	forwarder := newForwarder(
+		peerConnection.StreamId,
+		upTrack.ID(),
+		layerOf(upTrack),
+		upTrack.Kind(),
+		upTrack.Codec().RTPCodecCapability,
+		sendPLI,
+		sendNack,
+	)
+	go forwarder.Start(upTrack)
+
+	return forwarder
+}
+
+// forwardAll adds the audio and video tracks of the viewer, the video track receives the packets of a simulcast layer
+func (peerConnection *PeerConnection) forwardAll(other *PeerConnection) {
+	audio := make([]*Forwarder, 0)
+	video := make([]*Forwarder, 0)
+	var fallback *Forwarder
+	for _, forwarder := range peerConnection.Forwarders {
+		if forwarder.Kind != webrtc.RTPCodecTypeVideo {
+			audio = append(audio, forwarder)
+		} else if forwarder.Layer == FallbackLayer {
+			fallback = forwarder
+		} else {
+			video = append(video, forwarder)
+		}
 	}
+	if err := peerConnection.forwardTo(audio, nil, other); err != nil {
+		log.Err(err).Str("viewerId", other.Id).Msg("failed to add track")
+	}
+	if err := peerConnection.forwardTo(video, fallback, other); err != nil {
+		log.Err(err).Str("viewerId", other.Id).Msg("failed to add track")
+	}
+}
 
-	downTrack, err := webrtc.NewTrackLocalStaticSample(upTrack.Codec().RTPCodecCapability, upTrack.ID(), "proxy")
+// forwardTo adds a track of the viewer, receiving the packets of one of the forwarders,
+// or of the fallback forwarder if the viewer doesn't support their codec
+func (peerConnection *PeerConnection) forwardTo(forwarders []*Forwarder, fallback *Forwarder, other *PeerConnection) error {
+	if len(forwarders) == 0 {
+		return nil
+	}
+	selector := newLayerSelector(other.Id, forwarders)
+	forwarder := selector.Current()
+	startDownTrack := func() {
+		selector.Current().StartDownTrack(other.Id)
+	}
+	// the packets are dropped until the track is bound and the viewer is connected
+	onBind := func() {
+		other.OnConnected(startDownTrack)
+		if other.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			startDownTrack()
+		}
+	}
+	// the RTX SSRC is signaled before the track is bound, the fallback track retransmits with the same one
+	rtxSSRC := webrtc.SSRC(0)
+	if forwarder.Kind == webrtc.RTPCodecTypeVideo {
+		rtxSSRC = webrtc.SSRC(randomUint32())
+	}
+	track, err := forwarder.NewDownTrack(other.Id, rtxSSRC, onBind)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	maxLate := 1000
-	sb := samplebuilder.New(uint16(maxLate), depacketizer, upTrack.Codec().ClockRate)
-	go func() {
-		for {
-			packet, _, readErr := upTrack.ReadRTP()
-			if readErr != nil {
-				panic(readErr)
-			}
-			sb.Push(packet)
-			mediaSample := sb.Pop()
-			if mediaSample == nil {
-				continue
-			}
+	if fallback != nil {
+		fallbackDownTrack, err := fallback.NewDownTrack(other.Id, rtxSSRC, onBind)
+		if err != nil {
+			forwarder.RemoveDownTrack(other.Id)
+			return err
+		}
+		track = &fallbackTrack{
+			TrackLocal: track,
+			fallback:   fallbackDownTrack,
+			onBind: func(useFallback bool) {
+				if !useFallback {
+					// the fallback forwarder doesn't write to the viewers of the codec
+					fallback.RemoveDownTrack(other.Id)
+					return
+				}
+				log.Info().
+					Str("streamId", forwarder.StreamId).
+					Str("viewerId", other.Id).
+					Str("codec", forwarder.Codec.MimeType).
+					Msg("the viewer doesn't support the codec, forwarding the fallback track")
+				forwarder.RemoveDownTrack(other.Id)
+				selector.fallbackTo(fallback)
+			},
+		}
+	}
+	rtpSender, err := other.AddTrack(track)
+	if err != nil {
+		forwarder.RemoveDownTrack(other.Id)
+		if fallback != nil {
+			fallback.RemoveDownTrack(other.Id)
+		}
+		return err
+	}
+	go readViewerRTCP(rtpSender, selector)
+	other.OnDisconnected(selector.RemoveDownTrack)
+	if len(forwarders) > 1 {
+		other.OnLayer(selector.Pin)
+	}
+	return nil
+}
 
-			if err := downTrack.WriteSample(
-				*mediaSample,
-			); err != nil {
-				panic(err)
+// reads the RTCP packets of the viewer, the keyframe requests and NACKs are handled by the forwarder of the current layer
+func readViewerRTCP(rtpSender *webrtc.RTPSender, selector *layerSelector) {
+	for {
+		packets, _, err := rtpSender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				selector.Current().RequestKeyframe()
+			case *rtcp.TransportLayerNack:
+				selector.Current().HandleNack(selector.viewerId, packet)
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				selector.OnEstimate(float64(packet.Bitrate))
+			case *rtcp.ReceiverReport:
+				for _, report := range packet.Reports {
+					selector.OnLoss(report.FractionLost)
+				}
 			}
 		}
-	}()
-
-	return downTrack
+	}
 }
 
 func (peerConnection *PeerConnection) Initiate() {
@@ -213,7 +392,7 @@ func (peerConnection *PeerConnection) Initiate() {
 	signal := Signal{
 		ViewerId: peerConnection.Id,
 		Type:     "offer",
-		SDP:      offer.SDP,
+		SDP:      addRTXSSRCs(offer.SDP, peerConnection.rtxSSRCs()),
 	}
 
 	go peerConnection.EmitterVoid.Emit("signal", signal)
@@ -250,12 +429,12 @@ func connectDatachannel(a *PeerConnection, b *PeerConnection) {
 	}
 }
 
-func newConnection(Id string) (peerConnection *PeerConnection) {
+func newConnection(Id string, negotiateRTX bool) (peerConnection *PeerConnection) {
 	e := &emitter.Emitter{}
 	eVoid := &emitter.Emitter{}
 
 	eVoid.Use("*", emitter.Void)
-	localTracks := make([]*webrtc.TrackLocalStaticSample, 0)
+	forwarders := make([]*Forwarder, 0)
 	pendingCandidates := make([]*webrtc.ICECandidate, 0)
 	var snapshot *bytes.Buffer = nil
 
@@ -263,7 +442,8 @@ func newConnection(Id string) (peerConnection *PeerConnection) {
 	peerConnection = &PeerConnection{
 		EmitterVoid:       eVoid,
 		PendingCandidates: pendingCandidates,
-		LocalTracks:       localTracks,
+		Forwarders:        forwarders,
+		ExpectedTracks:    2,
 		Emitter:           e,
 		Id:                Id,
 		Signal: func(signal Signal) error {
@@ -307,6 +487,8 @@ func newConnection(Id string) (peerConnection *PeerConnection) {
 					log.Err(err).Send()
 					return err
 				}
+			case "layer":
+				go eVoid.Emit("layer", signal.Layer)
 			}
 			return nil
 		},
@@ -320,6 +502,11 @@ func newConnection(Id string) (peerConnection *PeerConnection) {
 				go cb()
 			})
 		},
+		OnLayer: func(cb func(layer string)) {
+			eVoid.On("layer", func(e *emitter.Event) {
+				go cb(e.Args[0].(string))
+			})
+		},
 		OnConnected: func(cb func()) {
 			eVoid.On("connected", func(e *emitter.Event) {
 				go cb()
@@ -330,42 +517,21 @@ func newConnection(Id string) (peerConnection *PeerConnection) {
 			connectDatachannel(peerConnection, other)
 			connectDatachannel(other, peerConnection)
 
-			if peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected && len(peerConnection.LocalTracks) == 2 {
-				for _, track := range peerConnection.LocalTracks {
-					other.AddTrack(track)
-				}
+			if peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected && peerConnection.hasAllTracks() {
+				peerConnection.forwardAll(other)
 			} else {
+				forwardOnce := sync.Once{}
 				peerConnection.OnConnected(func() {
 					peerConnection.EmitterVoid.On("track", func(e *emitter.Event) {
-						track := e.Args[0].(*webrtc.TrackLocalStaticSample)
-						_, err := other.AddTrack(track)
-						if err != nil {
-							panic(err)
-						}
-						//processRTCP(rtpSender)
-
-						// if we got audio and video
+						// if we got audio and all the video layers
 						// re-negotiate with the browser
-						if len(peerConnection.LocalTracks) == 2 {
-							other.Initiate()
+						if peerConnection.hasAllTracks() {
+							forwardOnce.Do(func() {
+								peerConnection.forwardAll(other)
+								other.Initiate()
+							})
 						}
 					})
-
-					/*
-						if len(peerConnection.LocalTracks) > 0 {
-							for _, track := range peerConnection.LocalTracks {
-								_, err := other.AddTrack(track)
-								if err != nil {
-									panic(err)
-								}
-								//processRTCP(rtpSender)
-							}
-
-							// re-negotiate with the browser
-							other.Initiate()
-
-						}
-					*/
 				})
 			}
 
@@ -380,19 +546,7 @@ func newConnection(Id string) (peerConnection *PeerConnection) {
 	}
 
 	//This will set the peerConnection.PeerConnection
-	peerConnection.initializeConnection()
+	peerConnection.initializeConnection(negotiateRTX)
 
 	return peerConnection
 }
-
-func processRTCP(rtpSender *webrtc.RTPSender) {
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
-}
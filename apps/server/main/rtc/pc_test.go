@@ -0,0 +1,47 @@
+package rtc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func testOffer(media ...string) webrtc.SessionDescription {
+	sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" + strings.Join(media, "")
+	return webrtc.SessionDescription{SDP: sdp, Type: webrtc.SDPTypeOffer}
+}
+
+func TestSendingMediaCount(t *testing.T) {
+	audio := func(direction string) string {
+		return "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\nc=IN IP4 0.0.0.0\r\n" + direction
+	}
+	video := func(direction string) string {
+		return "m=video 9 UDP/TLS/RTP/SAVPF 96\r\nc=IN IP4 0.0.0.0\r\n" + direction
+	}
+	tests := []struct {
+		name  string
+		offer webrtc.SessionDescription
+		want  int
+	}{
+		{"audio and video", testOffer(audio("a=sendonly\r\n"), video("a=sendonly\r\n")), 2},
+		{"video only", testOffer(video("a=sendonly\r\n")), 1},
+		{"extra video", testOffer(audio("a=sendrecv\r\n"), video("a=sendonly\r\n"), video("a=sendonly\r\n")), 3},
+		{"no direction is sendrecv", testOffer(video("")), 1},
+		{"viewer", testOffer(audio("a=recvonly\r\n"), video("a=recvonly\r\n")), 0},
+		{"inactive", testOffer(video("a=inactive\r\n")), 0},
+		{"rejected", testOffer("m=video 0 UDP/TLS/RTP/SAVPF 96\r\nc=IN IP4 0.0.0.0\r\na=sendonly\r\n"), 0},
+		{"data channel", testOffer("m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\nc=IN IP4 0.0.0.0\r\n", video("a=sendonly\r\n")), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := sendingMediaCount(test.offer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %d tracks, want %d", got, test.want)
+			}
+		})
+	}
+}
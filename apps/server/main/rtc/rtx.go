@@ -0,0 +1,196 @@
+package rtc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const mimeTypeRTX = "video/rtx"
+
+// a track of a viewer which retransmits on an RTX stream, the SSRC is signaled before the track is bound
+type rtxTrack interface {
+	rtxSSRC() webrtc.SSRC
+}
+
+// the writer of a viewer's track which retransmits on an RTX stream
+type rtxWriter interface {
+	// WriteRTX retransmits the packet, false if the viewer didn't negotiate RTX
+	WriteRTX(packet *rtp.Packet) (bool, error)
+}
+
+func randomUint32() uint32 {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// the RTX stream (RFC 4588) of a viewer's track, the retransmitted packets have their own SSRC,
+// payload type and sequence numbers, the original sequence number is the first 2 bytes of the payload
+type rtxStream struct {
+	ssrc  webrtc.SSRC
+	mutex sync.Mutex
+	// nil until the track is bound with a negotiated RTX codec
+	writeStream    webrtc.TrackLocalWriter
+	payloadType    webrtc.PayloadType
+	sequenceNumber uint16
+}
+
+func newRTXStream(ssrc webrtc.SSRC) *rtxStream {
+	return &rtxStream{
+		ssrc:           ssrc,
+		sequenceNumber: uint16(randomUint32()),
+	}
+}
+
+// the payload type of the RTX codec associated with the payload type of the media
+func findRTXPayloadType(codecs []webrtc.RTPCodecParameters, payloadType webrtc.PayloadType) (webrtc.PayloadType, bool) {
+	for _, codec := range codecs {
+		if !strings.EqualFold(codec.MimeType, mimeTypeRTX) {
+			continue
+		}
+		for _, parameter := range strings.Split(codec.SDPFmtpLine, ";") {
+			if strings.TrimSpace(parameter) == "apt="+strconv.Itoa(int(payloadType)) {
+				return codec.PayloadType, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// bind starts the RTX stream if the viewer negotiated RTX for the payload type of the track
+func (stream *rtxStream) bind(codecs []webrtc.RTPCodecParameters, payloadType webrtc.PayloadType, writeStream webrtc.TrackLocalWriter) {
+	rtxPayloadType, ok := findRTXPayloadType(codecs, payloadType)
+	if !ok || stream.ssrc == 0 {
+		return
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.payloadType = rtxPayloadType
+	stream.writeStream = writeStream
+}
+
+func (stream *rtxStream) unbind() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.writeStream = nil
+}
+
+func (stream *rtxStream) write(packet *rtp.Packet) (bool, error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.writeStream == nil {
+		return false, nil
+	}
+	header := packet.Header
+	header.Padding = false
+	header.PayloadType = uint8(stream.payloadType)
+	header.SSRC = uint32(stream.ssrc)
+	header.SequenceNumber = stream.sequenceNumber
+	stream.sequenceNumber++
+
+	payload := make([]byte, 2+len(packet.Payload))
+	binary.BigEndian.PutUint16(payload, packet.SequenceNumber)
+	copy(payload[2:], packet.Payload)
+	_, err := stream.writeStream.WriteRTP(&header, payload)
+	return true, err
+}
+
+// the RTX SSRC of the media SSRC of every sender
+func (peerConnection *PeerConnection) rtxSSRCs() map[uint32]uint32 {
+	ssrcs := make(map[uint32]uint32)
+	for _, sender := range peerConnection.GetSenders() {
+		track, ok := sender.Track().(rtxTrack)
+		if !ok || track.rtxSSRC() == 0 {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			ssrcs[uint32(encoding.SSRC)] = uint32(track.rtxSSRC())
+		}
+	}
+	return ssrcs
+}
+
+// adds the RTX SSRCs to the media sections which negotiate RTX, the senders of pion v3.1 signal the media SSRC only.
+// The RTX SSRC is grouped with the media SSRC (a=ssrc-group:FID) and gets the same attributes
+func addRTXSSRCs(sdp string, rtxSSRCs map[uint32]uint32) string {
+	if len(rtxSSRCs) == 0 {
+		return sdp
+	}
+	lines := strings.Split(strings.TrimRight(sdp, "\r\n"), "\r\n")
+	result := make([]string, 0, len(lines))
+	section := make([]string, 0)
+
+	flushSection := func() {
+		result = append(result, addSectionRTXSSRCs(section, rtxSSRCs)...)
+		section = make([]string, 0)
+	}
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			flushSection()
+		}
+		section = append(section, line)
+	}
+	flushSection()
+
+	return strings.Join(result, "\r\n") + "\r\n"
+}
+
+func addSectionRTXSSRCs(lines []string, rtxSSRCs map[uint32]uint32) []string {
+	hasRTX := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=rtpmap:") && strings.Contains(strings.ToLower(line), " rtx/") {
+			hasRTX = true
+		}
+	}
+	if !hasRTX {
+		return lines
+	}
+
+	result := make([]string, 0, len(lines))
+	grouped := make(map[uint32]bool)
+	// the attributes of the RTX SSRC, after the attributes of the media SSRC
+	pending := make([]string, 0)
+	for _, line := range lines {
+		ssrc, attribute, ok := parseSSRCLine(line)
+		rtxSSRC, hasRTXSSRC := rtxSSRCs[ssrc]
+		if !ok || !hasRTXSSRC {
+			result = append(result, pending...)
+			pending = pending[:0]
+			result = append(result, line)
+			continue
+		}
+		if !grouped[ssrc] {
+			grouped[ssrc] = true
+			result = append(result, fmt.Sprintf("a=ssrc-group:FID %d %d", ssrc, rtxSSRC))
+		}
+		result = append(result, line)
+		pending = append(pending, fmt.Sprintf("a=ssrc:%d %s", rtxSSRC, attribute))
+	}
+	return append(result, pending...)
+}
+
+// the SSRC and the attribute of an a=ssrc line
+func parseSSRCLine(line string) (uint32, string, bool) {
+	if !strings.HasPrefix(line, "a=ssrc:") {
+		return 0, "", false
+	}
+	ssrc, attribute, found := strings.Cut(strings.TrimPrefix(line, "a=ssrc:"), " ")
+	if !found {
+		return 0, "", false
+	}
+	parsed, err := strconv.ParseUint(ssrc, 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+	return uint32(parsed), attribute, true
+}
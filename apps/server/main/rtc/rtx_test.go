@@ -0,0 +1,283 @@
+package rtc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+type recordStream struct {
+	headers  []rtp.Header
+	payloads [][]byte
+}
+
+func (stream *recordStream) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	stream.headers = append(stream.headers, *header)
+	stream.payloads = append(stream.payloads, payload)
+	return header.MarshalSize() + len(payload), nil
+}
+
+func (stream *recordStream) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+var testCodecs = []webrtc.RTPCodecParameters{
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: 102},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/RTX", ClockRate: 90000, SDPFmtpLine: "rtx-time=3000; apt=102"}, PayloadType: 103},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000}, PayloadType: 98},
+}
+
+func TestFindRTXPayloadType(t *testing.T) {
+	tests := []struct {
+		name        string
+		payloadType webrtc.PayloadType
+		want        webrtc.PayloadType
+		wantOk      bool
+	}{
+		{"vp8", 96, 97, true},
+		{"other parameters and mime type case", 102, 103, true},
+		{"without RTX", 98, 0, false},
+		{"unknown payload type", 100, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := findRTXPayloadType(testCodecs, test.payloadType)
+			if got != test.want || ok != test.wantOk {
+				t.Errorf("got %d %v, want %d %v", got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestRTXStream(t *testing.T) {
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    96,
+			SequenceNumber: 1000,
+			Timestamp:      3000,
+			SSRC:           1234,
+		},
+		Payload: []byte{0x10, 0x00, 0x9d},
+	}
+
+	stream := newRTXStream(5678)
+	if sent, _ := stream.write(packet); sent {
+		t.Fatal("retransmitted before the track was bound")
+	}
+	writeStream := &recordStream{}
+	stream.bind(testCodecs, 96, writeStream)
+	firstSeq := stream.sequenceNumber
+	for i := 0; i < 2; i++ {
+		if sent, err := stream.write(packet); !sent || err != nil {
+			t.Fatalf("not retransmitted: %v", err)
+		}
+	}
+
+	want := rtp.Header{
+		Version:        2,
+		Marker:         true,
+		PayloadType:    97,
+		SequenceNumber: firstSeq,
+		Timestamp:      3000,
+		SSRC:           5678,
+	}
+	if !reflect.DeepEqual(writeStream.headers[0], want) {
+		t.Errorf("got header %+v, want %+v", writeStream.headers[0], want)
+	}
+	if seq := writeStream.headers[1].SequenceNumber; seq != firstSeq+1 {
+		t.Errorf("got sequence number %d, want %d", seq, firstSeq+1)
+	}
+	// the original sequence number, then the original payload
+	if payload := writeStream.payloads[0]; !reflect.DeepEqual(payload, []byte{0x03, 0xe8, 0x10, 0x00, 0x9d}) {
+		t.Errorf("got payload %x", payload)
+	}
+	if packet.SSRC != 1234 || packet.SequenceNumber != 1000 {
+		t.Error("the retransmitted packet was changed")
+	}
+
+	stream.unbind()
+	if sent, _ := stream.write(packet); sent {
+		t.Error("retransmitted after the track was unbound")
+	}
+	stream.bind(testCodecs, 98, writeStream)
+	if sent, _ := stream.write(packet); sent {
+		t.Error("retransmitted without a negotiated RTX codec")
+	}
+	noSSRC := newRTXStream(0)
+	noSSRC.bind(testCodecs, 96, writeStream)
+	if sent, _ := noSSRC.write(packet); sent {
+		t.Error("retransmitted without an RTX SSRC")
+	}
+}
+
+func TestAddRTXSSRCs(t *testing.T) {
+	sdp := strings.Join([]string{
+		"v=0",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 97",
+		"a=rtpmap:96 VP8/90000",
+		"a=rtpmap:97 rtx/90000",
+		"a=fmtp:97 apt=96",
+		"a=ssrc:1111 cname:stream",
+		"a=ssrc:1111 msid:stream video",
+		"a=msid:stream video",
+		"a=sendonly",
+		"m=video 9 UDP/TLS/RTP/SAVPF 98",
+		"a=rtpmap:98 VP9/90000",
+		"a=ssrc:2222 cname:stream",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=rtpmap:111 opus/48000/2",
+		"a=ssrc:3333 cname:stream",
+	}, "\r\n") + "\r\n"
+	want := strings.Join([]string{
+		"v=0",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 97",
+		"a=rtpmap:96 VP8/90000",
+		"a=rtpmap:97 rtx/90000",
+		"a=fmtp:97 apt=96",
+		"a=ssrc-group:FID 1111 5555",
+		"a=ssrc:1111 cname:stream",
+		"a=ssrc:1111 msid:stream video",
+		"a=ssrc:5555 cname:stream",
+		"a=ssrc:5555 msid:stream video",
+		"a=msid:stream video",
+		"a=sendonly",
+		// RTX isn't negotiated
+		"m=video 9 UDP/TLS/RTP/SAVPF 98",
+		"a=rtpmap:98 VP9/90000",
+		"a=ssrc:2222 cname:stream",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=rtpmap:111 opus/48000/2",
+		"a=ssrc:3333 cname:stream",
+	}, "\r\n") + "\r\n"
+
+	got := addRTXSSRCs(sdp, map[uint32]uint32{1111: 5555, 2222: 6666})
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := addRTXSSRCs(sdp, map[uint32]uint32{}); got != sdp {
+		t.Errorf("changed without RTX SSRCs:\n%s", got)
+	}
+}
+
+// answers the offer of a viewer supporting RTX, with the track of a VP8 forwarder
+func answerViewer(t *testing.T, negotiateRTX bool) (string, webrtc.SSRC) {
+	viewer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+	if _, err := viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := viewer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := SetupApi(negotiateRTX).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	nacked := []uint16{}
+	track, err := newTestForwarder("f", &nacked).NewDownTrack("viewer", 5555, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := server.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := server.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerConnection := &PeerConnection{PeerConnection: server}
+	return addRTXSSRCs(answer.SDP, peerConnection.rtxSSRCs()), sender.GetParameters().Encodings[0].SSRC
+}
+
+func TestNegotiateRTX(t *testing.T) {
+	answer, ssrc := answerViewer(t, true)
+	for _, line := range []string{
+		"a=rtpmap:97 rtx/90000",
+		"a=fmtp:97 apt=96",
+		fmt.Sprintf("a=ssrc-group:FID %d 5555", ssrc),
+		"a=ssrc:5555 cname:proxy",
+	} {
+		if !strings.Contains(answer, line+"\r\n") {
+			t.Errorf("the answer has no %q:\n%s", line, answer)
+		}
+	}
+
+	answer, _ = answerViewer(t, false)
+	if strings.Contains(answer, "rtx") || strings.Contains(answer, "ssrc-group") {
+		t.Errorf("RTX negotiated by a publisher connection:\n%s", answer)
+	}
+}
+
+func TestBindRTX(t *testing.T) {
+	viewer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+	if _, err := viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := viewer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(viewer)
+	if err := viewer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+
+	server, err := SetupApi(true).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	nacked := []uint16{}
+	bound := make(chan bool, 1)
+	track, err := newTestForwarder("f", &nacked).NewDownTrack("viewer", 5555, func() { bound <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	peerConnection := &PeerConnection{PeerConnection: server}
+	answer, err := peerConnection.AnswerOffer(viewer.LocalDescription().SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := viewer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-bound:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the track wasn't bound")
+	}
+	rtx := track.(*boundTrack).rtx
+	rtx.mutex.Lock()
+	defer rtx.mutex.Unlock()
+	if rtx.writeStream == nil || rtx.payloadType != 97 {
+		t.Errorf("the RTX stream isn't bound with the RTX payload type of VP8, payload type %d", rtx.payloadType)
+	}
+}
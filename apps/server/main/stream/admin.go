@@ -0,0 +1,170 @@
+package stream
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"signaling/main/auth"
+	"signaling/main/registry"
+	"signaling/main/rtc"
+	"signaling/main/webhooks"
+
+	"github.com/labstack/echo/v5"
+	"github.com/rs/zerolog/log"
+)
+
+type AdminStreamEntry struct {
+	StreamId        string   `json:"streamId"`
+	Viewers         []string `json:"viewers"`
+	Uptime          int      `json:"uptime"`
+	IsAvailable     bool     `json:"available"`
+	IsDirectConnect bool     `json:"directConnect"`
+	IsPrivate       bool     `json:"private"`
+	IsWhip          bool     `json:"whip"`
+	IsTerminated    bool     `json:"terminated"`
+	Owner           string   `json:"owner,omitempty"`
+}
+
+type BlockedStreamEntry struct {
+	StreamId  string `json:"streamId"`
+	BlockedAt int64  `json:"blockedAt"`
+}
+
+// the capture client receives the kick signals before the stream is removed
+const terminatedStreamTTL = time.Second * 10
+
+// Admin routes, operating the running server
+func startAdminServer(
+	g *echo.Group,
+	streamManager *StreamManager,
+	streamRegistry *registry.Registry,
+	dispatcher *webhooks.Dispatcher,
+	isDirectConnect func(stream *Stream) bool,
+	closeViewerSockets func(streamId string, viewerId string),
+) {
+	if !auth.IsAdminEnabled() {
+		log.Warn().Msg("the admin api is disabled, it requires the admin feature and the admin token")
+	}
+
+	admin := g.Group("/admin", auth.RequireAdminToken)
+
+	kickViewer := func(stream *Stream, viewerId string) {
+		if isDirectConnect(stream) {
+			// the capture client closes the P2P connection
+			stream.SignalToCaptureClient(rtc.Signal{
+				ViewerId: viewerId,
+				Type:     "kick",
+			})
+		} else {
+			stream.ViewerManager.RemoveConnection(viewerId)
+		}
+		closeViewerSockets(stream.Id, viewerId)
+	}
+
+	terminateStream := func(stream *Stream) {
+		stream.Terminate()
+		streamManager.AddTombstone(strings.TrimSuffix(stream.Id, runId))
+		for _, viewerId := range stream.GetViewerIds() {
+			kickViewer(stream, viewerId)
+		}
+		closeViewerSockets(stream.Id, "")
+		time.AfterFunc(terminatedStreamTTL, func() {
+			// the capture client may have connected again in the meantime
+			if streamManager.GetStream(stream.Id) == stream {
+				streamManager.RemoveStream(stream.Id)
+			}
+		})
+	}
+
+	admin.GET("/streams", func(c echo.Context) error {
+		response := make([]AdminStreamEntry, 0)
+		for streamId_runId, stream := range streamManager.GetStreams() {
+			streamId := strings.TrimSuffix(streamId_runId, runId)
+			entry := AdminStreamEntry{
+				StreamId:        streamId,
+				Viewers:         stream.GetViewerIds(),
+				Uptime:          int(stream.GetUptime().Seconds()),
+				IsAvailable:     stream.IsAvailable(),
+				IsDirectConnect: isDirectConnect(stream),
+				IsPrivate:       stream.IsPrivate,
+				IsWhip:          stream.IsWhip,
+				IsTerminated:    stream.IsTerminated(),
+			}
+			if record := streamRegistry.Get(streamId); record != nil {
+				entry.Owner = record.Owner
+			}
+			response = append(response, entry)
+		}
+		return c.JSON(http.StatusOK, response)
+	})
+
+	admin.DELETE("/streams/:streamId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		stream := streamManager.GetStream(streamId + runId)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "{\"message\":\"stream not found\"}")
+		}
+		log.Info().
+			Str("streamId", streamId).
+			Msg("admin terminated stream")
+		terminateStream(stream)
+		return c.String(http.StatusOK, "OK")
+	})
+
+	admin.DELETE("/streams/:streamId/viewers/:viewerId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		viewerId := c.PathParam("viewerId")
+		stream := streamManager.GetStream(streamId + runId)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "{\"message\":\"stream not found\"}")
+		}
+		log.Info().
+			Str("streamId", streamId).
+			Str("viewerId", viewerId).
+			Msg("admin kicked viewer")
+		kickViewer(stream, viewerId)
+		return c.String(http.StatusOK, "OK")
+	})
+
+	admin.GET("/blocked", func(c echo.Context) error {
+		response := make([]BlockedStreamEntry, 0)
+		for streamId, blockedAt := range streamRegistry.GetBlocked() {
+			response = append(response, BlockedStreamEntry{
+				StreamId:  streamId,
+				BlockedAt: blockedAt.Unix(),
+			})
+		}
+		return c.JSON(http.StatusOK, response)
+	})
+
+	admin.PUT("/blocked/:streamId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		if err := streamRegistry.Block(streamId); err != nil {
+			return c.String(http.StatusInternalServerError, "{\"message\":\"failed to block stream\"}")
+		}
+		log.Info().
+			Str("streamId", streamId).
+			Msg("admin blocked stream")
+		if stream := streamManager.GetStream(streamId + runId); stream != nil {
+			terminateStream(stream)
+		}
+		return c.String(http.StatusOK, "OK")
+	})
+
+	admin.DELETE("/blocked/:streamId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		if err := streamRegistry.Unblock(streamId); err != nil {
+			return c.String(http.StatusInternalServerError, "{\"message\":\"failed to unblock stream\"}")
+		}
+		log.Info().
+			Str("streamId", streamId).
+			Msg("admin unblocked stream")
+		return c.String(http.StatusOK, "OK")
+	})
+
+	// the most recent webhook deliveries, oldest first
+	admin.GET("/webhooks/deliveries", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, dispatcher.GetDeliveries())
+	})
+}
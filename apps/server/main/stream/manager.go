@@ -2,7 +2,12 @@ package stream
 
 import (
 	"bytes"
+	"signaling/main/registry"
 	"signaling/main/rtc"
+	"signaling/main/utils"
+	"signaling/main/webhooks"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v5"
@@ -27,18 +32,33 @@ type Stream struct {
 	SignalToCaptureClient      func(signal rtc.Signal) error
 	SignalFromCaptureClient    func(signal rtc.Signal) error
 	ConnectClient              func() *rtc.PeerConnection
+	ConnectWhipClient          func(offer string) (string, error)
 	NewViewer                  func(viewerId string) *rtc.PeerConnection
 	GetViewer                  func(viewerId string) *rtc.PeerConnection
 	GetViewerCount             func() int
 	OnClientConnectionEvent    func(event ConnectionEvent)
 	GetViewers                 func() map[string]*rtc.PeerConnection
-	GetSignalsForCaptureClient func() chan []rtc.Signal
+	GetViewerIds               func() []string
+	GetSignalsForCaptureClient func(done <-chan struct{}) []rtc.Signal
 	IsAvailable                func() bool
+	KeepAlive                  func()
 	IsDirectConnect            bool
 	IsPrivate                  bool
+	IsRemoteEnabled            bool
+	SimulcastLayers            int
+	HasFallback                bool
+	IsWhip                     bool
+	ViewerPasswordHash         string
+	IsTerminated               func() bool
+	Terminate                  func()
+	WhipResourceId             string
 	GetUptime                  func() time.Duration
 	OnViewerConnected          func(cb func(connectionId string))
 	OnViewerDisconnected       func(cb func(connectionId string))
+
+	// Done is closed when the stream is replaced by a reconnecting capture client or removed
+	Done  func() <-chan struct{}
+	close func()
 }
 
 type StreamManager struct {
@@ -46,35 +66,83 @@ type StreamManager struct {
 	GetStreams            func() map[string]*Stream
 	GetStream             func(streamId string) *Stream
 	NewStream             func(streamId string, isDirectConnect bool, isPrivate bool) *Stream
+	NewWhipStream         func(streamId string, isPrivate bool) *Stream
+	RemoveStream          func(streamId string)
+	RestoreStreams        func()
 	SetSnapshot           func(streamId string, snapshot *bytes.Buffer)
 	SetP2PConnectionCount func(streamId string, count int)
 	GetSnapshot           func(streamId string) *bytes.Buffer
 	ListStreams           func() []ListStreamsResponseEntry
+	AddTombstone          func(streamId string)
+	HasTombstone          func(streamId string) bool
 }
 
-/////////////////////////////streamId///viewerId//signals
-var to_client_signal_buffers = make(map[string][]rtc.Signal, 0)
-
-func NewStreamManager(g *echo.Group) *StreamManager {
+func NewStreamManager(
+	g *echo.Group,
+	streamRegistry *registry.Registry,
+	dispatcher *webhooks.Dispatcher,
+	terminatedStreamCooldown time.Duration,
+) *StreamManager {
 
 	//A map to store connections by their ID
 	var streams = make(map[string]*Stream)
+	// the streams are created and removed by the http and socket handlers, read by the metrics and the admin api
+	streamsMutex := sync.RWMutex{}
+	getStream := func(streamId string) *Stream {
+		streamsMutex.RLock()
+		defer streamsMutex.RUnlock()
+		return streams[streamId]
+	}
+	// a copy of the streams, it can be iterated while the streams change
+	getStreams := func() map[string]*Stream {
+		streamsMutex.RLock()
+		defer streamsMutex.RUnlock()
+		snapshot := make(map[string]*Stream, len(streams))
+		for streamId, stream := range streams {
+			snapshot[streamId] = stream
+		}
+		return snapshot
+	}
 	e := &emitter.Emitter{}
 	e.Use("*", emitter.Void)
 
-	clientConnectionManager := rtc.NewConnectionManager()
+	clientConnectionManager := rtc.NewConnectionManager(false)
+
+	// streamId -> online, to fire the webhooks only when the availability changes
+	onlineStreams := make(map[string]bool)
+	onlineStreamsMutex := sync.Mutex{}
+	setStreamOnline := func(streamId string, isOnline bool) {
+		onlineStreamsMutex.Lock()
+		if onlineStreams[streamId] == isOnline {
+			onlineStreamsMutex.Unlock()
+			return
+		}
+		onlineStreams[streamId] = isOnline
+		onlineStreamsMutex.Unlock()
+
+		event := webhooks.EventStreamOffline
+		if isOnline {
+			event = webhooks.EventStreamOnline
+		}
+		dispatcher.Send(event, webhooks.EventData{StreamId: strings.TrimSuffix(streamId, runId)})
+	}
 
 	manager := &StreamManager{
-		streams: streams,
-		GetStreams: func() map[string]*Stream {
-			return streams
-		},
-		GetStream: func(streamId string) *Stream {
-			return streams[streamId]
-		},
+		streams:    streams,
+		GetStreams: getStreams,
+		GetStream:  getStream,
 		NewStream: func(streamId string, isDirectConnect bool, isPrivate bool) (stream *Stream) {
 
+			// the stream id without the run id, for the metrics and webhooks
+			publicStreamId := strings.TrimSuffix(streamId, runId)
+			// the P2P viewers are updated by the connection events of the capture client,
+			// they and the termination are read by the admin api and the metrics
+			mutex := sync.Mutex{}
 			p2pConnectionCount := 0
+			p2pViewerIds := make(map[string]bool)
+			isTerminated := false
+			done := make(chan struct{})
+			closeOnce := sync.Once{}
 			isAvailable := false
 			keepAliveInterrupt := make(chan bool)
 			uptime := time.Duration(0)
@@ -91,23 +159,39 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 						return
 					case <-time.After(time.Second * 15):
 						isAvailable = false
+						// the stream could be replaced by a reconnecting capture client
+						if getStream(streamId) == stream {
+							setStreamOnline(streamId, false)
+						}
 					}
 				}()
 				uptime = time.Since(now)
 				isAvailable = true
+				setStreamOnline(streamId, true)
 			}
 
 			var viewer_manager *rtc.ConnectionManager
 
 			// fix leaky subscription
-			existing_stream := streams[streamId]
+			existing_stream := getStream(streamId)
 			if existing_stream != nil {
 				viewer_manager = existing_stream.ViewerManager
 			} else {
-				viewer_manager = rtc.NewConnectionManager()
+				viewer_manager = rtc.NewConnectionManager(true)
+				// subscribe only once, the viewer manager is reused by the recreated streams
+				viewer_manager.OnConnection(func(viewerId string) {
+					dispatcher.Send(webhooks.EventViewerConnected, webhooks.EventData{StreamId: publicStreamId, ViewerId: viewerId})
+				})
+				viewer_manager.OnDisconnected(func(viewerId string) {
+					dispatcher.Send(webhooks.EventViewerDisconnected, webhooks.EventData{StreamId: publicStreamId, ViewerId: viewerId})
+				})
 			}
 
 			viewer_manager.OnAllDisconnected(func() {
+				// the WHIP client publishes regardless of the viewers
+				if stream.IsWhip {
+					return
+				}
 				// when all viewers disconnected from this stream,
 				// disconnect the server(this code) from the capture client
 				clientConnectionManager.RemoveConnection(streamId)
@@ -117,12 +201,55 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 			// remove the client connection if exists(stale connection)
 			clientConnectionManager.RemoveConnection(streamId)
 
-			to_client_signal_buffers[streamId] = make([]rtc.Signal, 0)
+			// the signals to the capture client, buffered until it polls them or the websocket sends them
+			signals := make([]rtc.Signal, 0)
+			signalsMutex := sync.Mutex{}
+			// notifies the waiting capture client transport(long-poll or websocket)
+			signalsReady := make(chan bool, 1)
+			pushSignal := func(signal rtc.Signal) {
+				signalsMutex.Lock()
+				signals = append(signals, signal)
+				signalsMutex.Unlock()
+				select {
+				case signalsReady <- true:
+				default:
+				}
+			}
+			takeSignals := func() []rtc.Signal {
+				signalsMutex.Lock()
+				defer signalsMutex.Unlock()
+				taken := signals
+				signals = make([]rtc.Signal, 0)
+				return taken
+			}
+
+			watchClientConnection := func(conn *rtc.PeerConnection) {
+				// 30 fps ticker
+				ticker := time.NewTicker(time.Second / 30)
+				defer ticker.Stop()
+				for range ticker.C {
+					if conn.ConnectionState() == webrtc.PeerConnectionStateClosed {
+						log.Error().
+							Str("streamId", streamId).
+							Msg("client disconnected")
+						// connection to the capture client, set to nil, so that it can be recreated
+						if stream.Connection == conn {
+							stream.Connection = nil
+						}
+						return
+					}
+					// the WHIP client doesn't poll, it is available as long as it's connected
+					if stream.IsWhip && conn.ConnectionState() == webrtc.PeerConnectionStateConnected {
+						keepAlive()
+					}
+				}
+			}
 
 			snapshot := bytes.NewBuffer(nil)
 			stream = &Stream{
 				IsDirectConnect: isDirectConnect,
 				IsPrivate:       isPrivate,
+				SimulcastLayers: 1,
 				ViewerManager:   viewer_manager,
 				Id:              streamId,
 				Connection:      nil,
@@ -132,6 +259,7 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 				IsAvailable: func() bool {
 					return isAvailable
 				},
+				KeepAlive: keepAlive,
 				GetSnapshot: func() *bytes.Buffer {
 					return snapshot
 				},
@@ -141,45 +269,40 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 				},
 
 				SignalToCaptureClient: func(signal rtc.Signal) error {
-
-					to_client_signal_buffers[streamId] = append(to_client_signal_buffers[streamId], signal)
+					pushSignal(signal)
 					return nil
 				},
 				SignalFromCaptureClient: func(signal rtc.Signal) error {
 					keepAlive()
 					return nil
 				},
-				GetSignalsForCaptureClient: func() chan []rtc.Signal {
+				GetSignalsForCaptureClient: func(done <-chan struct{}) []rtc.Signal {
 					keepAlive()
-					signals_to_send := make(chan []rtc.Signal)
-					go func() {
-						now := time.Now()
-						// 10 fps ticker
-						ticker := time.NewTicker(time.Second / 10)
-						for range ticker.C {
-
-							//if 10 seconds passed, return empty array
-							if time.Since(now) > 10*time.Second {
-								signals_to_send <- make([]rtc.Signal, 0)
-								return
-							}
-
-							if to_client_signal_buffers[streamId] != nil {
-								if len(to_client_signal_buffers[streamId]) > 0 {
-									signals_to_send <- (to_client_signal_buffers[streamId])
-
-									to_client_signal_buffers[streamId] = make([]rtc.Signal, 0)
-									return
-								}
-							}
-
+					timeout := time.After(10 * time.Second)
+					for {
+						if signals := takeSignals(); len(signals) > 0 {
+							return signals
 						}
-					}()
-
-					return signals_to_send
+						select {
+						case <-signalsReady:
+						case <-done:
+							return make([]rtc.Signal, 0)
+						//if 10 seconds passed, return empty array
+						case <-timeout:
+							return make([]rtc.Signal, 0)
+						}
+					}
 				},
 				NewViewer: func(viewerId string) *rtc.PeerConnection {
 					viewerConnection := viewer_manager.NewConnection(viewerId)
+					viewerConnection.StreamId = publicStreamId
+					viewerConnection.Role = "viewer"
+					// the viewer sends the control commands through the data channel
+					viewerConnection.EmitterVoid.Once("datach-message", func(ev *emitter.Event) {
+						if stream.IsRemoteEnabled {
+							dispatcher.Send(webhooks.EventRemoteSessionStarted, webhooks.EventData{StreamId: publicStreamId, ViewerId: viewerId})
+						}
+					})
 
 					return viewerConnection
 				},
@@ -189,8 +312,43 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 				GetViewers: func() map[string]*rtc.PeerConnection {
 					return viewer_manager.GetConnections()
 				},
+				GetViewerIds: func() []string {
+					viewerIds := make([]string, 0)
+					if isDirectConnect {
+						mutex.Lock()
+						defer mutex.Unlock()
+						for viewerId := range p2pViewerIds {
+							viewerIds = append(viewerIds, viewerId)
+						}
+						return viewerIds
+					}
+					for viewerId := range viewer_manager.GetConnections() {
+						viewerIds = append(viewerIds, viewerId)
+					}
+					return viewerIds
+				},
+				Done: func() <-chan struct{} {
+					return done
+				},
+				close: func() {
+					closeOnce.Do(func() {
+						close(done)
+					})
+				},
+				IsTerminated: func() bool {
+					mutex.Lock()
+					defer mutex.Unlock()
+					return isTerminated
+				},
+				Terminate: func() {
+					mutex.Lock()
+					defer mutex.Unlock()
+					isTerminated = true
+				},
 				GetViewerCount: func() int {
 					if isDirectConnect {
+						mutex.Lock()
+						defer mutex.Unlock()
 						return p2pConnectionCount
 					}
 					return len(viewer_manager.GetConnections())
@@ -218,11 +376,24 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 					if !isDirectConnect {
 						return
 					}
-					p2pConnectionCount = event.ViewerCount
-					if event.Type == "viewer_connected" {
+					eventData := webhooks.EventData{StreamId: publicStreamId, ViewerId: event.ViewerId}
+					switch event.Type {
+					case "remote_session_started":
+						dispatcher.Send(webhooks.EventRemoteSessionStarted, eventData)
+					case "viewer_connected":
+						mutex.Lock()
+						p2pConnectionCount = event.ViewerCount
+						p2pViewerIds[event.ViewerId] = true
+						mutex.Unlock()
 						go e.Emit("p2p_viewer_connected", event.ViewerId)
-					} else {
+						dispatcher.Send(webhooks.EventViewerConnected, eventData)
+					default:
+						mutex.Lock()
+						p2pConnectionCount = event.ViewerCount
+						delete(p2pViewerIds, event.ViewerId)
+						mutex.Unlock()
 						go e.Emit("p2p_viewer_disconnected", event.ViewerId)
+						dispatcher.Send(webhooks.EventViewerDisconnected, eventData)
 					}
 				},
 				ConnectClient: func() *rtc.PeerConnection {
@@ -232,32 +403,25 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 					if conn == nil {
 						conn = clientConnectionManager.NewConnection(streamId)
 					}
+					conn.StreamId = publicStreamId
+					conn.Role = "publisher"
 
-					go func() {
-						// 30 fps ticker
-						ticker := time.NewTicker(time.Second / 30)
-						for range ticker.C {
-							if conn.ConnectionState() == webrtc.PeerConnectionStateClosed {
-								log.Error().
-									Str("streamId", streamId).
-									Msg("client disconnected")
-								// connection to the capture client, set to nil, so that it can be recreated
-								stream.Connection = nil
-								return
-							}
-						}
-					}()
+					go watchClientConnection(conn)
 
 					conn.OnSignal(func(signal rtc.Signal) {
-
 						// forward the signal to the capture client
-						to_client_signal_buffers[streamId] = append(
-							to_client_signal_buffers[streamId],
-							signal)
+						pushSignal(signal)
 					})
 
-					// allow receiving tracks from the capture client
-					conn.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+					// allow receiving tracks from the capture client, a video track for every simulcast layer
+					videoTracks := stream.SimulcastLayers
+					if stream.HasFallback {
+						videoTracks++
+					}
+					for i := 0; i < videoTracks; i++ {
+						conn.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+					}
+					conn.ExpectedTracks = videoTracks + 1
 					conn.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
 					dc, err := conn.CreateDataChannel("data", nil)
 					if err != nil {
@@ -273,23 +437,61 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 					stream.Connection = conn
 					return stream.Connection
 				},
+				ConnectWhipClient: func(offer string) (string, error) {
+					clientConnectionManager.RemoveConnection(streamId)
+					conn := clientConnectionManager.NewConnection(streamId)
+					conn.StreamId = publicStreamId
+					conn.Role = "publisher"
+
+					answer, err := conn.AnswerOffer(offer)
+					if err != nil {
+						clientConnectionManager.RemoveConnection(streamId)
+						return "", err
+					}
+
+					go watchClientConnection(conn)
+					stream.Connection = conn
+					return answer, nil
+				},
 			}
 
+			streamsMutex.Lock()
+			if previous := streams[streamId]; previous != nil {
+				previous.close()
+			}
 			streams[streamId] = stream
+			streamsMutex.Unlock()
 			return stream
 		},
+		RemoveStream: func(streamId string) {
+			streamsMutex.Lock()
+			stream := streams[streamId]
+			if stream == nil {
+				streamsMutex.Unlock()
+				return
+			}
+			delete(streams, streamId)
+			streamsMutex.Unlock()
+			stream.close()
+			for viewerId := range stream.GetViewers() {
+				stream.ViewerManager.RemoveConnection(viewerId)
+			}
+			clientConnectionManager.RemoveConnection(streamId)
+			streamRegistry.Remove(strings.TrimSuffix(streamId, runId))
+			setStreamOnline(streamId, false)
+		},
 		SetSnapshot: func(streamId string, snapshot *bytes.Buffer) {
-			streams[streamId].SetSnapshot(snapshot)
+			getStream(streamId).SetSnapshot(snapshot)
 		},
 
 		GetSnapshot: func(streamId string) *bytes.Buffer {
-			return streams[streamId].GetSnapshot()
+			return getStream(streamId).GetSnapshot()
 		},
 		ListStreams: func() []ListStreamsResponseEntry {
 			response := make([]ListStreamsResponseEntry, 0)
 
-			for streamId_runId, stream := range streams {
-				if !stream.IsAvailable() || stream.IsPrivate {
+			for streamId_runId, stream := range getStreams() {
+				if !stream.IsAvailable() || stream.IsPrivate || stream.IsTerminated() {
 					continue
 				}
 				streamId := streamId_runId[:len(streamId_runId)-len(runId)]
@@ -304,6 +506,56 @@ func NewStreamManager(g *echo.Group) *StreamManager {
 		},
 	}
 
+	// a stream published through WHIP, the server is connected directly to the publisher
+	manager.NewWhipStream = func(streamId string, isPrivate bool) *Stream {
+		stream := manager.NewStream(streamId, false, isPrivate)
+		stream.IsWhip = true
+		stream.WhipResourceId = utils.RandomStr()
+		return stream
+	}
+
+	// streamId(without the run id) -> termination time, the capture client re-initializes its stream
+	// after it's removed, a terminated stream can't connect again until the cooldown is over
+	tombstones := make(map[string]time.Time)
+	tombstonesMutex := sync.Mutex{}
+	manager.AddTombstone = func(streamId string) {
+		if terminatedStreamCooldown == 0 {
+			return
+		}
+		tombstonesMutex.Lock()
+		defer tombstonesMutex.Unlock()
+		tombstones[streamId] = time.Now()
+	}
+	manager.HasTombstone = func(streamId string) bool {
+		tombstonesMutex.Lock()
+		defer tombstonesMutex.Unlock()
+		terminatedAt, ok := tombstones[streamId]
+		if ok && time.Since(terminatedAt) >= terminatedStreamCooldown {
+			delete(tombstones, streamId)
+			return false
+		}
+		return ok
+	}
+
+	// recreates the streams of the registry after a restart,
+	// the capture clients can continue polling them without reconnecting
+	manager.RestoreStreams = func() {
+		for _, record := range streamRegistry.GetAll() {
+			stream := manager.NewStream(record.StreamId+runId, record.IsDirectConnect, record.IsPrivate)
+			stream.ViewerPasswordHash = record.ViewerPasswordHash
+			stream.IsRemoteEnabled = record.IsRemoteEnabled
+			if record.SimulcastLayers > 1 {
+				stream.SimulcastLayers = record.SimulcastLayers
+			}
+			stream.HasFallback = record.HasFallback
+			// list it until the capture client polls again
+			stream.KeepAlive()
+			log.Info().
+				Str("streamId", record.StreamId).
+				Msg("stream restored from registry")
+		}
+	}
+
 	return manager
 
 }
@@ -0,0 +1,33 @@
+package stream
+
+import (
+	"strings"
+
+	"signaling/main/metrics"
+)
+
+// updates the stream gauges before every scrape
+func startMetricsCollector(streamManager *StreamManager, isDirectConnect func(stream *Stream) bool) {
+	metrics.OnCollect(func() {
+		metrics.ActiveStreams.Reset()
+		metrics.StreamViewers.Reset()
+		// report the modes without streams as well
+		for _, mode := range []string{"sfu", "direct", "whip"} {
+			metrics.ActiveStreams.Set(0, mode)
+		}
+
+		for streamId, stream := range streamManager.GetStreams() {
+			if !stream.IsAvailable() || stream.IsTerminated() {
+				continue
+			}
+			mode := "sfu"
+			if stream.IsWhip {
+				mode = "whip"
+			} else if isDirectConnect(stream) {
+				mode = "direct"
+			}
+			metrics.ActiveStreams.Inc(mode)
+			metrics.StreamViewers.Set(float64(stream.GetViewerCount()), strings.TrimSuffix(streamId, runId))
+		}
+	})
+}
@@ -7,9 +7,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-
+	"strings"
+	"sync"
+	"time"
+
+	"signaling/main/auth"
+	"signaling/main/config"
+	"signaling/main/metrics"
+	"signaling/main/registry"
 	"signaling/main/rtc"
+	"signaling/main/turnserver"
 	"signaling/main/utils"
+	"signaling/main/webhooks"
 
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/labstack/echo/v5"
@@ -17,8 +26,24 @@ import (
 )
 
 type NewStreamBody struct {
-	IsDirectConnect bool `json:"isDirectConnect"`
-	IsPrivate       bool `json:"isPrivate"`
+	IsDirectConnect bool   `json:"isDirectConnect"`
+	IsPrivate       bool   `json:"isPrivate"`
+	IsRemoteEnabled bool   `json:"isRemoteEnabled"`
+	SimulcastLayers int    `json:"simulcastLayers"`
+	HasFallback     bool   `json:"hasFallback"`
+	Owner           string `json:"owner"`
+	ViewerPassword  string `json:"viewerPassword"`
+}
+
+type ViewerTokenBody struct {
+	Password string `json:"password"`
+	// seconds, only the capture client can set it
+	TTL int `json:"ttl"`
+}
+
+type ViewerTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
 }
 
 var runId = utils.RandomStr()
@@ -38,13 +63,114 @@ type ConnectionEvent struct {
 	ViewerCount int    `json:"viewerCount"`
 }
 
-func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
+func StartSignalingServer(g *echo.Group, ss *socketio.Server, serverConfig *config.Config) {
 
-	config := rtc.GetRtcConfig()
-	iceServers := config.ICEServers
-	directConnect := config.DirectConnect
+	g.Use(metrics.Middleware)
 
-	streamManager := NewStreamManager(g)
+	directConnect := rtc.GetRtcConfig().DirectConnect
+
+	var embeddedTurnServer *turnserver.TurnServer
+	if serverConfig.Turn.Enabled {
+		turnServer, err := turnserver.Start(serverConfig.Turn, serverConfig.GetTurnCredentialTTL())
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to start the embedded turn server")
+		}
+		embeddedTurnServer = turnServer
+	}
+
+	// the configured ICE servers and the embedded turn server, with new credentials for the user
+	getIceServers := func(userId string) []rtc.ICEServer {
+		iceServers := rtc.GetIceServers(userId)
+		if embeddedTurnServer == nil {
+			return iceServers
+		}
+		return append([]rtc.ICEServer{embeddedTurnServer.GetIceServer(userId)}, iceServers...)
+	}
+
+	streamRegistry, err := registry.OpenRegistry(serverConfig.StreamRegistryPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open the stream registry")
+	}
+	if streamRegistry.IsPersistent {
+		// the stream ids survive the restart, no need to force new connections
+		runId = ""
+	}
+
+	dispatcher := webhooks.NewDispatcher(serverConfig.Webhooks.URLs, serverConfig.Webhooks.Secret)
+	if dispatcher.IsEnabled && serverConfig.Webhooks.Secret == "" {
+		log.Warn().Msg("the webhook secret is not set, the webhook payloads are not signed")
+	}
+	if !auth.IsStreamKeyRequired() {
+		log.Warn().Msg("the stream key secret is not set, the capture clients of private streams can't issue viewer tokens")
+	}
+
+	streamManager := NewStreamManager(g, streamRegistry, dispatcher, serverConfig.GetTerminatedStreamCooldown())
+	streamManager.RestoreStreams()
+
+	// WHIP streams are always forwarded by the server
+	isDirectConnect := func(stream *Stream) bool {
+		return !stream.IsWhip && (directConnect || stream.IsDirectConnect)
+	}
+
+	// private and password protected streams can only be watched with a viewer token or the password
+	canView := func(stream *Stream, password string, token string) bool {
+		if !stream.IsPrivate && stream.ViewerPasswordHash == "" {
+			return true
+		}
+		publicStreamId := strings.TrimSuffix(stream.Id, runId)
+		if token != "" && auth.VerifyViewerToken(publicStreamId, token) {
+			return true
+		}
+		return auth.VerifyViewerPassword(stream.ViewerPasswordHash, password)
+	}
+
+	// signals sent by the capture client, either through http or websocket
+	handleCaptureClientSignals := func(stream *Stream, signals []rtc.Signal) {
+		if isDirectConnect(stream) {
+			for _, signal := range signals {
+				// the answer to a WHEP viewer is returned in the http response
+				if deliverWhepSignal(signal) {
+					continue
+				}
+				viewerId := signal.ViewerId
+				go ss.BroadcastToRoom("/", viewerId, "signal", signal)
+			}
+		} else {
+			cc := stream.Connection
+			if cc == nil {
+				return
+			}
+			for _, signal := range signals {
+				cc.Signal(signal)
+			}
+		}
+	}
+
+	// viewerId -> socket of the viewer, to close it when the viewer is kicked
+	viewerSockets := make(map[string]socketio.Conn)
+	viewerSocketsMutex := sync.Mutex{}
+	// closes the socket of the viewer, or all the viewer sockets of the stream if viewerId is empty
+	closeViewerSockets := func(streamId string, viewerId string) {
+		viewerSocketsMutex.Lock()
+		defer viewerSocketsMutex.Unlock()
+		for id, s := range viewerSockets {
+			ctx, ok := s.Context().(*ViewerSocketContext)
+			if !ok || ctx.StreamId != streamId || (viewerId != "" && id != viewerId) {
+				continue
+			}
+			delete(viewerSockets, id)
+			go s.Close()
+		}
+	}
+
+	if serverConfig.Features.Whip {
+		startWhipServer(g, streamManager, streamRegistry, getIceServers)
+	}
+	if serverConfig.Features.Whep {
+		startWhepServer(g, streamManager, getIceServers, isDirectConnect, canView)
+	}
+	startAdminServer(g, streamManager, streamRegistry, dispatcher, isDirectConnect, closeViewerSockets)
+	startMetricsCollector(streamManager, isDirectConnect)
 
 	g.GET("/streams", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, streamManager.ListStreams())
@@ -58,15 +184,54 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 			Msg("viewer called /snapshot/:streamId")
 
 		streamId = streamId + runId
-		snapshot := streamManager.GetSnapshot(streamId)
+		stream := streamManager.GetStream(streamId)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "{\"message\":\"stream not found\"}")
+		}
+		password, token := auth.GetViewerCredentials(c)
+		if !canView(stream, password, token) {
+			return c.String(http.StatusUnauthorized, "{\"message\":\"invalid viewer credentials\"}")
+		}
+		snapshot := stream.GetSnapshot()
 		return c.Blob(http.StatusOK, "image/jpg", snapshot.Bytes())
 	})
 
+	// exchanges the viewer password for a viewer token
+	g.POST("/viewer-token/:streamId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		stream := streamManager.GetStream(streamId + runId)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "{\"message\":\"stream not found\"}")
+		}
+		body := utils.ParseBody[ViewerTokenBody](c)
+		if !auth.VerifyViewerPassword(stream.ViewerPasswordHash, body.Value.Password) {
+			return c.String(http.StatusUnauthorized, "{\"message\":\"invalid viewer credentials\"}")
+		}
+		token, expiresAt := auth.IssueViewerToken(streamId, auth.DefaultViewerTokenTTL)
+		return c.JSON(http.StatusOK, ViewerTokenResponse{Token: token, ExpiresAt: expiresAt.Unix()})
+	})
+
+	// Client route, the streamer can share viewer tokens for private streams
+	g.POST("/viewer-token/:streamId/internal", func(c echo.Context) error {
+		// without the secret the stream key isn't checked, anyone could request a token
+		if !auth.IsStreamKeyRequired() {
+			return c.String(http.StatusForbidden, "{\"message\":\"viewer tokens require the stream key secret\"}")
+		}
+		streamId := c.PathParam("streamId")
+		body := utils.ParseBody[ViewerTokenBody](c)
+		ttl := auth.DefaultViewerTokenTTL
+		if body.Value.TTL > 0 {
+			ttl = time.Duration(body.Value.TTL) * time.Second
+		}
+		token, expiresAt := auth.IssueViewerToken(streamId, ttl)
+		return c.JSON(http.StatusOK, ViewerTokenResponse{Token: token, ExpiresAt: expiresAt.Unix()})
+	}, auth.RequireStreamKey)
+
 	g.GET("/ice-config", func(c echo.Context) error {
 		log.Info().
 			Msg("client called /ice-config")
 
-		return c.JSON(http.StatusOK, iceServers)
+		return c.JSON(http.StatusOK, getIceServers(utils.RandomStr()))
 	})
 
 	ss.OnConnect("/", func(s socketio.Conn) error {
@@ -78,18 +243,26 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 
 		url := s.URL()
 		key := url.Query().Get("streamKey")
-		streamId := url.Query().Get("streamId")
-		streamId = streamId + runId
+		publicStreamId := url.Query().Get("streamId")
+		streamId := publicStreamId + runId
 
 		log.Info().
 			Str("url", url.String()).
 			Str("streamId", streamId).
-			Str("streamKey", key).
+			Bool("hasStreamKey", key != "").
 			Msg("Socket args")
 
+		if key != "" && !auth.VerifyStreamKey(publicStreamId, key) {
+			log.Warn().
+				Str("streamId", streamId).
+				Msg("streamer socket rejected, invalid stream key")
+			s.Close()
+			return nil
+		}
+
 		stream := streamManager.GetStream(streamId)
 
-		if stream == nil {
+		if stream == nil || stream.IsTerminated() {
 			log.Error().
 				Str("streamId", streamId).
 				Msg("stream not found")
@@ -97,6 +270,14 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 			return nil
 		}
 
+		if key == "" && !canView(stream, url.Query().Get("password"), url.Query().Get("token")) {
+			log.Warn().
+				Str("streamId", streamId).
+				Msg("viewer socket rejected, invalid viewer credentials")
+			s.Close()
+			return nil
+		}
+
 		stream.OnViewerConnected(func(connectionId string) {
 			event := ConnectionEvent{
 				Type:        "viewer_connected",
@@ -120,13 +301,15 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 			viewerId := utils.RandomStr()
 			s.SetContext(&ViewerSocketContext{StreamId: streamId, ViewerId: viewerId})
 			s.Join(viewerId)
+			viewerSocketsMutex.Lock()
+			viewerSockets[viewerId] = s
+			viewerSocketsMutex.Unlock()
 
 			fmt.Println("viewer connected:", viewerId)
 
 		} else {
 			// the streamer can listen for events for their own stream
 			// for now, only viewer connect/disconenct events are supported
-			//TODO: validate the key, for now there is no data returned
 			s.SetContext(&StreamerSocketContext{StreamId: streamId})
 			s.Join(streamId)
 			fmt.Println("streamer connected:", streamId)
@@ -134,6 +317,16 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 		return nil
 	})
 
+	ss.OnDisconnect("/", func(s socketio.Conn, reason string) {
+		ctx, ok := s.Context().(*ViewerSocketContext)
+		if !ok {
+			return
+		}
+		viewerSocketsMutex.Lock()
+		delete(viewerSockets, ctx.ViewerId)
+		viewerSocketsMutex.Unlock()
+	})
+
 	// Viewer route
 	ss.OnEvent("/", "signal", func(s socketio.Conn, msg string) error {
 
@@ -150,11 +343,11 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 			Str("streamId", streamId).
 			Msg("viewer called /signal/:streamId")
 
-		if stream == nil || !stream.IsAvailable() {
+		if stream == nil || !stream.IsAvailable() || stream.IsTerminated() {
 			return nil
 		}
 
-		if directConnect || stream.IsDirectConnect {
+		if isDirectConnect(stream) {
 			log.Info().Msg("direct connect")
 			for _, signal := range signals.Value {
 				signal.ViewerId = viewerId
@@ -166,6 +359,10 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 		} else {
 			// connect the server to the capture client
 			if stream.Connection == nil {
+				// the WHIP client has to publish again
+				if stream.IsWhip {
+					return nil
+				}
 				stream.ConnectClient()
 			}
 
@@ -210,7 +407,7 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 		streamManager.SetSnapshot(streamId, buffer)
 
 		return c.String(http.StatusOK, "OK")
-	})
+	}, auth.RequireStreamKey)
 
 	// Client route
 	g.POST("/conn-evt/:streamId/internal", func(c echo.Context) error {
@@ -231,27 +428,62 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 		stream.OnClientConnectionEvent(event)
 
 		return c.String(http.StatusOK, "OK")
-	})
+	}, auth.RequireStreamKey)
 
 	// Client route
 	g.POST("/connect/:streamId/internal", func(c echo.Context) error {
 		streamId := c.PathParam("streamId")
+		if streamRegistry.IsBlocked(streamId) {
+			log.Warn().
+				Str("streamId", streamId).
+				Msg("blocked stream tried to connect")
+			return c.String(http.StatusForbidden, "{\"message\":\"stream is blocked\"}")
+		}
+		if streamManager.HasTombstone(streamId) {
+			log.Warn().
+				Str("streamId", streamId).
+				Msg("terminated stream tried to connect")
+			return c.String(http.StatusForbidden, "{\"message\":\"stream was terminated\"}")
+		}
 		// if the server is restarted, need to force a new connection
 		streamId = streamId + runId
 		body := utils.ParseBody[NewStreamBody](c)
 		isDirectConnect := body.Value.IsDirectConnect
 		isPrivate := body.Value.IsPrivate
-		streamManager.NewStream(streamId, isDirectConnect, isPrivate)
+		viewerPasswordHash, err := auth.HashViewerPassword(body.Value.ViewerPassword)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "{\"message\":\"invalid viewer password\"}")
+		}
+		stream := streamManager.NewStream(streamId, isDirectConnect, isPrivate)
+		stream.ViewerPasswordHash = viewerPasswordHash
+		stream.IsRemoteEnabled = body.Value.IsRemoteEnabled
+		if body.Value.SimulcastLayers > 1 {
+			stream.SimulcastLayers = body.Value.SimulcastLayers
+		}
+		if stream.SimulcastLayers > rtc.MaxSimulcastLayers {
+			stream.SimulcastLayers = rtc.MaxSimulcastLayers
+		}
+		stream.HasFallback = body.Value.HasFallback
+
+		streamRegistry.Save(registry.StreamRecord{
+			StreamId:           c.PathParam("streamId"),
+			IsDirectConnect:    isDirectConnect,
+			IsPrivate:          isPrivate,
+			IsRemoteEnabled:    body.Value.IsRemoteEnabled,
+			SimulcastLayers:    stream.SimulcastLayers,
+			HasFallback:        stream.HasFallback,
+			Owner:              body.Value.Owner,
+			KeyHash:            auth.HashStreamKey(auth.GetStreamKey(c)),
+			ViewerPasswordHash: viewerPasswordHash,
+		})
 
 		return c.String(http.StatusOK, "OK")
-	})
+	}, auth.RequireStreamKey)
 
 	// Client route
 	g.GET("/signal/:streamId/internal", func(c echo.Context) error {
 		streamId := c.PathParam("streamId")
 
-		signals_to_send := make(chan []rtc.Signal)
-
 		log.Info().
 			Str("method", "GET").
 			Str("streamId", streamId).
@@ -263,20 +495,10 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 		if stream == nil {
 			return c.String(http.StatusNotFound, "{\"message\":\"stream not found\"}")
 		}
-		go func() {
-			for {
-				select {
-				case <-c.Request().Context().Done():
-					return
-				case signals := <-stream.GetSignalsForCaptureClient():
-
-					signals_to_send <- signals
-				}
-			}
-		}()
-		json, _ := json.Marshal(utils.SortSignals(<-signals_to_send))
+		signals := stream.GetSignalsForCaptureClient(c.Request().Context().Done())
+		json, _ := json.Marshal(utils.SortSignals(signals))
 		return c.String(http.StatusOK, string(json))
-	})
+	}, auth.RequireStreamKey)
 
 	// Client route
 	g.POST("/signal/:streamId/internal", func(c echo.Context) error {
@@ -291,20 +513,32 @@ func StartSignalingServer(g *echo.Group, ss *socketio.Server) {
 		// if the server is restarted, need to force a new connection
 		streamId = streamId + runId
 		stream := streamManager.GetStream(streamId)
-
-		if directConnect || stream.IsDirectConnect {
-			for _, signal := range signals.Value {
-				viewerId := signal.ViewerId
-				go ss.BroadcastToRoom("/", viewerId, "signal", signal)
-			}
-		} else {
-			cc := stream.Connection
-			for _, signal := range signals.Value {
-				cc.Signal(signal)
-			}
+		if stream == nil {
+			return c.String(http.StatusNotFound, "{\"message\":\"stream not found\"}")
 		}
 
+		handleCaptureClientSignals(stream, signals.Value)
+
 		return c.String(http.StatusOK, "OK")
-	})
+	}, auth.RequireStreamKey)
+
+	// Client route, the same signaling as above over a single websocket
+	g.GET("/ws/:streamId/internal", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+
+		log.Info().
+			Str("method", "GET").
+			Str("streamId", streamId).
+			Msg("client called /ws/:streamId/internal")
+
+		// if the server is restarted, need to force a new connection
+		streamId = streamId + runId
+		stream := streamManager.GetStream(streamId)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "{\"message\":\"stream not found\"}")
+		}
+
+		return serveCaptureClientSocket(c, stream, handleCaptureClientSignals)
+	}, auth.RequireStreamKey)
 
 }
@@ -0,0 +1,122 @@
+package stream
+
+import (
+	"encoding/json"
+	"time"
+
+	"signaling/main/rtc"
+	"signaling/main/utils"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	socketWriteWait  = 10 * time.Second
+	socketPongWait   = 30 * time.Second
+	socketPingPeriod = socketPongWait / 2
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// serveCaptureClientSocket pushes the signals for the capture client as soon as they are available
+// and passes the received signals to handleSignals, until the socket is closed or the stream is replaced
+func serveCaptureClientSocket(c echo.Context, stream *Stream, handleSignals func(stream *Stream, signals []rtc.Signal)) error {
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		log.Err(err).Str("streamId", stream.Id).Msg("websocket upgrade failed")
+		return nil
+	}
+	defer ws.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-stream.Done():
+			// the capture client connected again or the stream was removed, it reconnects the socket to the current stream
+			log.Info().Str("streamId", stream.Id).Msg("closing the capture client socket of a replaced stream")
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	// writer, the only goroutine that writes to the socket
+	go func() {
+		ticker := time.NewTicker(socketPingPeriod)
+		defer ticker.Stop()
+		outgoing := make(chan []rtc.Signal)
+		go func() {
+			for {
+				signals := stream.GetSignalsForCaptureClient(done)
+				if len(signals) == 0 {
+					select {
+					case <-done:
+						return
+					default:
+						continue
+					}
+				}
+				select {
+				case outgoing <- signals:
+				case <-done:
+					// keep them for the next connection of the capture client
+					requeueSignals(stream, signals)
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case <-done:
+				return
+			case signals := <-outgoing:
+				ws.SetWriteDeadline(time.Now().Add(socketWriteWait))
+				if err := ws.WriteJSON(utils.SortSignals(signals)); err != nil {
+					log.Err(err).Str("streamId", stream.Id).Msg("failed to write to capture client socket")
+					requeueSignals(stream, signals)
+					ws.Close()
+					return
+				}
+			case <-ticker.C:
+				ws.SetWriteDeadline(time.Now().Add(socketWriteWait))
+				if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	ws.SetReadDeadline(time.Now().Add(socketPongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(socketPongWait))
+		return nil
+	})
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			log.Info().Str("streamId", stream.Id).Msg("capture client socket closed")
+			close(done)
+			return nil
+		}
+		var signals []rtc.Signal
+		if err := json.Unmarshal(msg, &signals); err != nil {
+			log.Err(err).Str("streamId", stream.Id).Msg("invalid signal message")
+			continue
+		}
+		handleSignals(stream, signals)
+	}
+}
+
+func requeueSignals(stream *Stream, signals []rtc.Signal) {
+	for _, signal := range signals {
+		stream.SignalToCaptureClient(signal)
+	}
+}
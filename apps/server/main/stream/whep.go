@@ -0,0 +1,298 @@
+package stream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"signaling/main/auth"
+	"signaling/main/rtc"
+	"signaling/main/utils"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// the WHEP requests waiting for the signals of the capture client, by viewerId
+var whep_signal_waiters = make(map[string]chan rtc.Signal)
+var whep_signal_waiters_mutex = sync.Mutex{}
+
+// the WHEP resources of the direct connect viewers, viewerId -> streamId, the capture client holds their connections
+var whep_direct_resources = make(map[string]string)
+var whep_direct_resources_mutex = sync.Mutex{}
+
+// deliverWhepSignal passes the signal from the capture client to the WHEP request waiting for it,
+// returns false if the signal is for a socket viewer
+func deliverWhepSignal(signal rtc.Signal) bool {
+	whep_signal_waiters_mutex.Lock()
+	defer whep_signal_waiters_mutex.Unlock()
+	waiter := whep_signal_waiters[signal.ViewerId]
+	if waiter == nil {
+		return false
+	}
+	select {
+	case waiter <- signal:
+	default:
+	}
+	return true
+}
+
+// forwards the offer to the capture client and waits for its answer, in direct connect mode.
+// The capture client trickles its candidates, they are collected into the answer
+// because WHEP players don't receive candidates from the server.
+func getAnswerFromCaptureClient(stream *Stream, viewerId string, offer string) (string, bool) {
+	waiter := make(chan rtc.Signal, 100)
+	whep_signal_waiters_mutex.Lock()
+	whep_signal_waiters[viewerId] = waiter
+	whep_signal_waiters_mutex.Unlock()
+	defer func() {
+		whep_signal_waiters_mutex.Lock()
+		delete(whep_signal_waiters, viewerId)
+		whep_signal_waiters_mutex.Unlock()
+	}()
+
+	stream.SignalToCaptureClient(rtc.Signal{
+		ViewerId: viewerId,
+		Type:     "offer",
+		SDP:      offer,
+	})
+
+	var answer *rtc.Signal
+	candidates := make([]webrtc.ICECandidateInit, 0)
+	timeout := time.After(15 * time.Second)
+	var gatheringTimeout <-chan time.Time
+
+	for {
+		select {
+		case signal := <-waiter:
+			if signal.Type == "answer" && answer == nil {
+				answer = &signal
+				gatheringTimeout = time.After(2 * time.Second)
+			} else if signal.Type == "candidate" {
+				candidates = append(candidates, signal.Candidate)
+			}
+		case <-gatheringTimeout:
+			return addCandidatesToSDP(answer.SDP, candidates), true
+		case <-timeout:
+			if answer == nil {
+				return "", false
+			}
+			return addCandidatesToSDP(answer.SDP, candidates), true
+		}
+	}
+}
+
+// WebRTC-HTTP Egress Protocol, watching a stream with a single offer/answer exchange
+func startWhepServer(
+	g *echo.Group,
+	streamManager *StreamManager,
+	getIceServers func(userId string) []rtc.ICEServer,
+	isDirectConnect func(stream *Stream) bool,
+	canView func(stream *Stream, password string, token string) bool,
+) {
+
+	g.POST("/whep/:streamId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		log.Info().
+			Str("method", "POST").
+			Str("streamId", streamId).
+			Msg("viewer called /whep/:streamId")
+
+		if !strings.HasPrefix(c.Request().Header.Get("Content-Type"), "application/sdp") {
+			return c.String(http.StatusUnsupportedMediaType, "expected application/sdp")
+		}
+
+		offer, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+
+		streamId = streamId + runId
+		stream := streamManager.GetStream(streamId)
+		if stream == nil || !stream.IsAvailable() || stream.IsTerminated() {
+			return c.String(http.StatusNotFound, "stream not found")
+		}
+
+		password, token := auth.GetViewerCredentials(c)
+		if !canView(stream, password, token) {
+			return c.String(http.StatusUnauthorized, "invalid viewer credentials")
+		}
+
+		viewerId := utils.RandomStr()
+		var answer string
+
+		if isDirectConnect(stream) {
+			var ok bool
+			answer, ok = getAnswerFromCaptureClient(stream, viewerId, string(offer))
+			if !ok {
+				return c.String(http.StatusGatewayTimeout, "capture client didn't answer")
+			}
+			whep_direct_resources_mutex.Lock()
+			whep_direct_resources[viewerId] = streamId
+			whep_direct_resources_mutex.Unlock()
+		} else {
+			// connect the server to the capture client
+			if stream.Connection == nil {
+				if stream.IsWhip {
+					return c.String(http.StatusNotFound, "stream not found")
+				}
+				stream.ConnectClient()
+			}
+
+			// the tracks have to be added before answering, WHEP can't renegotiate
+			source := stream.Connection
+			if !source.WaitForTracks(15 * time.Second) {
+				return c.String(http.StatusServiceUnavailable, "stream is not ready")
+			}
+
+			viewerConnection := stream.NewViewer(viewerId)
+			// build the pipeline: capture client -> server -> viewer
+			source.ConnectTo(viewerConnection)
+
+			answer, err = viewerConnection.AnswerOffer(string(offer))
+			if err != nil {
+				log.Err(err).Str("streamId", streamId).Msg("failed to answer WHEP offer")
+				stream.ViewerManager.RemoveConnection(viewerId)
+				return c.String(http.StatusBadRequest, "invalid offer")
+			}
+		}
+
+		for _, iceServer := range getIceServers(viewerId) {
+			for _, url := range iceServer.URLs {
+				c.Response().Header().Add("Link", getIceServerLink(url, iceServer))
+			}
+		}
+		c.Response().Header().Set("Location", c.Request().URL.Path+"/"+viewerId)
+		return c.Blob(http.StatusCreated, "application/sdp", []byte(answer))
+	})
+
+	// trickle ICE
+	g.PATCH("/whep/:streamId/:resourceId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId") + runId
+		viewerId := c.PathParam("resourceId")
+		stream := streamManager.GetStream(streamId)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "resource not found")
+		}
+
+		if !strings.HasPrefix(c.Request().Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+			return c.String(http.StatusUnsupportedMediaType, "expected application/trickle-ice-sdpfrag")
+		}
+
+		body, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+		candidates := parseTrickleCandidates(string(body))
+
+		if isDirectConnect(stream) {
+			whep_direct_resources_mutex.Lock()
+			resourceStreamId, ok := whep_direct_resources[viewerId]
+			whep_direct_resources_mutex.Unlock()
+			if !ok || resourceStreamId != streamId {
+				return c.String(http.StatusNotFound, "resource not found")
+			}
+			for _, candidate := range candidates {
+				stream.SignalToCaptureClient(rtc.Signal{
+					ViewerId:  viewerId,
+					Type:      "candidate",
+					Candidate: candidate,
+				})
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+
+		viewerConnection := stream.GetViewer(viewerId)
+		if viewerConnection == nil {
+			return c.String(http.StatusNotFound, "resource not found")
+		}
+		for _, candidate := range candidates {
+			if err := viewerConnection.AddICECandidate(candidate); err != nil {
+				log.Err(err).Str("viewerId", viewerId).Msg("failed to add WHEP candidate")
+				return c.String(http.StatusBadRequest, "invalid candidate")
+			}
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	// teardown
+	g.DELETE("/whep/:streamId/:resourceId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId") + runId
+		viewerId := c.PathParam("resourceId")
+		stream := streamManager.GetStream(streamId)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "resource not found")
+		}
+
+		log.Info().
+			Str("method", "DELETE").
+			Str("streamId", streamId).
+			Str("viewerId", viewerId).
+			Msg("viewer called /whep/:streamId/:resourceId")
+
+		if isDirectConnect(stream) {
+			whep_direct_resources_mutex.Lock()
+			resourceStreamId, ok := whep_direct_resources[viewerId]
+			if ok && resourceStreamId == streamId {
+				delete(whep_direct_resources, viewerId)
+			}
+			whep_direct_resources_mutex.Unlock()
+			if !ok || resourceStreamId != streamId {
+				return c.String(http.StatusNotFound, "resource not found")
+			}
+			// the capture client closes the P2P connection, like kicking the viewer
+			stream.SignalToCaptureClient(rtc.Signal{
+				ViewerId: viewerId,
+				Type:     "kick",
+			})
+			return c.String(http.StatusOK, "OK")
+		}
+
+		if stream.GetViewer(viewerId) == nil {
+			return c.String(http.StatusNotFound, "resource not found")
+		}
+		stream.ViewerManager.RemoveConnection(viewerId)
+		return c.String(http.StatusOK, "OK")
+	})
+}
+
+// adds the a=candidate lines to the media sections of the SDP, matched by their mid
+func addCandidatesToSDP(sdp string, candidates []webrtc.ICECandidateInit) string {
+	if len(candidates) == 0 {
+		return sdp
+	}
+	lines := strings.Split(strings.TrimRight(sdp, "\r\n"), "\r\n")
+	result := make([]string, 0, len(lines)+len(candidates))
+	sectionIndex := -1
+	sectionMid := ""
+
+	flushSection := func() {
+		if sectionIndex < 0 {
+			return
+		}
+		for _, candidate := range candidates {
+			matches := candidate.SDPMid == nil && sectionIndex == 0 ||
+				candidate.SDPMid != nil && *candidate.SDPMid == sectionMid
+			if matches {
+				result = append(result, "a="+candidate.Candidate)
+			}
+		}
+	}
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			flushSection()
+			sectionIndex++
+			sectionMid = ""
+		} else if strings.HasPrefix(line, "a=mid:") {
+			sectionMid = strings.TrimPrefix(line, "a=mid:")
+		}
+		result = append(result, line)
+	}
+	flushSection()
+
+	return strings.Join(result, "\r\n") + "\r\n"
+}
@@ -0,0 +1,145 @@
+package stream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"signaling/main/auth"
+	"signaling/main/registry"
+	"signaling/main/rtc"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// WebRTC-HTTP Ingestion Protocol, publishing into a stream from OBS, whipsink, ffmpeg...
+// The published stream is forwarded by the server to the viewers, like a capture client in SFU mode.
+func startWhipServer(g *echo.Group, streamManager *StreamManager, streamRegistry *registry.Registry, getIceServers func(userId string) []rtc.ICEServer) {
+
+	g.POST("/whip/:streamId", func(c echo.Context) error {
+		streamId := c.PathParam("streamId")
+		log.Info().
+			Str("method", "POST").
+			Str("streamId", streamId).
+			Msg("client called /whip/:streamId")
+
+		if !strings.HasPrefix(c.Request().Header.Get("Content-Type"), "application/sdp") {
+			return c.String(http.StatusUnsupportedMediaType, "expected application/sdp")
+		}
+
+		if streamRegistry.IsBlocked(streamId) {
+			return c.String(http.StatusForbidden, "stream is blocked")
+		}
+		if streamManager.HasTombstone(streamId) {
+			return c.String(http.StatusForbidden, "stream was terminated")
+		}
+
+		offer, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+
+		streamId = streamId + runId
+		existing := streamManager.GetStream(streamId)
+		if existing != nil && !existing.IsWhip && existing.IsAvailable() {
+			return c.String(http.StatusConflict, "stream is published by a capture client")
+		}
+
+		stream := streamManager.NewWhipStream(streamId, c.QueryParam("private") == "true")
+		answer, err := stream.ConnectWhipClient(string(offer))
+		if err != nil {
+			log.Err(err).Str("streamId", streamId).Msg("failed to answer WHIP offer")
+			streamManager.RemoveStream(streamId)
+			return c.String(http.StatusBadRequest, "invalid offer")
+		}
+
+		for _, iceServer := range getIceServers(c.PathParam("streamId")) {
+			for _, url := range iceServer.URLs {
+				c.Response().Header().Add("Link", getIceServerLink(url, iceServer))
+			}
+		}
+		c.Response().Header().Set("Location", c.Request().URL.Path+"/"+stream.WhipResourceId)
+		return c.Blob(http.StatusCreated, "application/sdp", []byte(answer))
+	}, auth.RequireStreamKey)
+
+	getWhipStream := func(c echo.Context) *Stream {
+		streamId := c.PathParam("streamId") + runId
+		stream := streamManager.GetStream(streamId)
+		if stream == nil || !stream.IsWhip || stream.WhipResourceId != c.PathParam("resourceId") {
+			return nil
+		}
+		return stream
+	}
+
+	// trickle ICE
+	g.PATCH("/whip/:streamId/:resourceId", func(c echo.Context) error {
+		stream := getWhipStream(c)
+		if stream == nil || stream.Connection == nil {
+			return c.String(http.StatusNotFound, "resource not found")
+		}
+
+		if !strings.HasPrefix(c.Request().Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+			return c.String(http.StatusUnsupportedMediaType, "expected application/trickle-ice-sdpfrag")
+		}
+
+		body, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+
+		for _, candidate := range parseTrickleCandidates(string(body)) {
+			if err := stream.Connection.AddICECandidate(candidate); err != nil {
+				log.Err(err).Str("streamId", stream.Id).Msg("failed to add WHIP candidate")
+				return c.String(http.StatusBadRequest, "invalid candidate")
+			}
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}, auth.RequireStreamKey)
+
+	// teardown
+	g.DELETE("/whip/:streamId/:resourceId", func(c echo.Context) error {
+		stream := getWhipStream(c)
+		if stream == nil {
+			return c.String(http.StatusNotFound, "resource not found")
+		}
+
+		log.Info().
+			Str("method", "DELETE").
+			Str("streamId", stream.Id).
+			Msg("client called /whip/:streamId/:resourceId")
+
+		streamManager.RemoveStream(stream.Id)
+		return c.String(http.StatusOK, "OK")
+	}, auth.RequireStreamKey)
+}
+
+func getIceServerLink(url string, iceServer rtc.ICEServer) string {
+	link := fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+	if iceServer.Username != "" {
+		link += fmt.Sprintf("; username=\"%s\"; credential=\"%v\"; credential-type=\"password\"", iceServer.Username, iceServer.Credential)
+	}
+	return link
+}
+
+// the candidates of an application/trickle-ice-sdpfrag body
+func parseTrickleCandidates(sdpfrag string) []webrtc.ICECandidateInit {
+	candidates := make([]webrtc.ICECandidateInit, 0)
+	var mid *string
+	for _, line := range strings.Split(sdpfrag, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=mid:") {
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		} else if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+		}
+	}
+	return candidates
+}
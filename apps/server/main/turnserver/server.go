@@ -0,0 +1,255 @@
+package turnserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"signaling/main/auth"
+	"signaling/main/config"
+	"signaling/main/rtc"
+
+	"github.com/pion/turn/v2"
+	"github.com/rs/zerolog/log"
+)
+
+type TurnServer struct {
+	// GetIceServer returns the STUN/TURN urls of the server with new credentials for the user
+	GetIceServer func(userId string) rtc.ICEServer
+	Close        func() error
+}
+
+// Start listens on udp and tcp, relaying through the public ip
+func Start(turnConfig config.Turn, credentialTTL time.Duration) (*TurnServer, error) {
+	secret := turnConfig.Secret
+	if secret == "" {
+		// the credentials are only valid until the server is restarted
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	udpListener, err := net.ListenPacket("udp4", turnConfig.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on udp %s: %w", turnConfig.ListenAddress, err)
+	}
+	tcpListener, err := net.Listen("tcp4", turnConfig.ListenAddress)
+	if err != nil {
+		udpListener.Close()
+		return nil, fmt.Errorf("failed to listen on tcp %s: %w", turnConfig.ListenAddress, err)
+	}
+
+	relayAddressGenerator := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP(turnConfig.PublicIP),
+			Address:      "0.0.0.0",
+		}
+	}
+
+	sessions := newAuthSessions(secret, time.Now)
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       turnConfig.Realm,
+		AuthHandler: sessions.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            &observedPacketConn{PacketConn: udpListener, onResponse: sessions.onResponse},
+				RelayAddressGenerator: relayAddressGenerator(),
+			},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              &observedListener{Listener: tcpListener, onResponse: sessions.onResponse},
+				RelayAddressGenerator: relayAddressGenerator(),
+			},
+		},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return nil, err
+	}
+
+	pruneTicker := time.NewTicker(time.Minute)
+	stopPruning := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-pruneTicker.C:
+				sessions.prune()
+			case <-stopPruning:
+				pruneTicker.Stop()
+				return
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(turnConfig.ListenAddress)
+	host := net.JoinHostPort(turnConfig.PublicIP, port)
+
+	log.Info().
+		Str("address", turnConfig.ListenAddress).
+		Str("publicIp", turnConfig.PublicIP).
+		Msg("embedded turn server started")
+
+	return &TurnServer{
+		GetIceServer: func(userId string) rtc.ICEServer {
+			credentials := auth.IssueTurnCredentials(secret, userId, credentialTTL)
+			return rtc.ICEServer{
+				URLs: []string{
+					"stun:" + host,
+					"turn:" + host + "?transport=udp",
+					"turn:" + host + "?transport=tcp",
+				},
+				Username:       credentials.Username,
+				Credential:     credentials.Password,
+				CredentialType: "password",
+				ExpiresAt:      credentials.ExpiresAt.Unix(),
+			}
+		},
+		Close: func() error {
+			close(stopPruning)
+			return server.Close()
+		},
+	}, nil
+}
+
+// how long a client can go without refreshing its allocation before its expired credentials are rejected,
+// above the 10 minutes lifetime of the allocations
+const sessionIdleTimeout = 15 * time.Minute
+
+// the requests are answered right away, a request without a response is forgotten after this time
+const pendingRequestTimeout = time.Minute
+
+// the header of the STUN messages (RFC 5389) and the types of the successful Allocate and Refresh responses (RFC 5766)
+const (
+	stunHeaderSize          = 20
+	stunMagicCookie         = 0x2112A442
+	stunResponseClass       = 0x0100
+	allocateSuccessResponse = 0x0103
+	refreshSuccessResponse  = 0x0104
+)
+
+type pendingRequest struct {
+	username   string
+	receivedAt time.Time
+}
+
+// the sessions of the clients, by address and username. The auth handler of pion is called before the message
+// integrity is checked, so a session is only recorded when the server answers an Allocate or Refresh with success
+type authSessions struct {
+	// the AuthHandler of the turn server
+	authenticate func(username string, realm string, srcAddr net.Addr) ([]byte, bool)
+	// observes the messages sent by the turn server to the clients
+	onResponse func(b []byte, dstAddr net.Addr)
+	// removes the idle sessions and the requests left without a response
+	prune func()
+}
+
+// newAuthSessions accepts the credentials signed with the secret until they expire.
+// The clients keep sending the username their allocation was created with on every refresh,
+// the credentials of a live connection are never updated, so the expired username is still
+// accepted from the address it was used from before it expired, as long as the allocation
+// is refreshed. New allocations need new credentials.
+func newAuthSessions(secret string, now func() time.Time) *authSessions {
+	// address/username -> time of the last successful Allocate or Refresh
+	sessions := map[string]time.Time{}
+	// address -> the request being handled, pion handles the requests of an address one at a time
+	pending := map[string]pendingRequest{}
+	mutex := sync.Mutex{}
+
+	return &authSessions{
+		authenticate: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+			address := srcAddr.String()
+			mutex.Lock()
+			defer mutex.Unlock()
+			_, existingSession := sessions[address+"/"+username]
+			if auth.IsTurnUsernameExpired(username) && !existingSession {
+				log.Warn().
+					Str("username", username).
+					Str("address", address).
+					Msg("rejected expired turn credentials")
+				return nil, false
+			}
+			pending[address] = pendingRequest{username: username, receivedAt: now()}
+
+			password := auth.SignTurnUsername(secret, username)
+			return turn.GenerateAuthKey(username, realm, password), true
+		},
+		onResponse: func(b []byte, dstAddr net.Addr) {
+			if len(b) < stunHeaderSize || binary.BigEndian.Uint32(b[4:8]) != stunMagicCookie {
+				return
+			}
+			messageType := binary.BigEndian.Uint16(b[0:2])
+			if messageType&stunResponseClass == 0 {
+				return
+			}
+			address := dstAddr.String()
+			mutex.Lock()
+			defer mutex.Unlock()
+			request, ok := pending[address]
+			if !ok {
+				return
+			}
+			delete(pending, address)
+			if messageType == allocateSuccessResponse || messageType == refreshSuccessResponse {
+				sessions[address+"/"+request.username] = now()
+			}
+		},
+		prune: func() {
+			currentTime := now()
+			mutex.Lock()
+			defer mutex.Unlock()
+			for key, lastSeen := range sessions {
+				if currentTime.Sub(lastSeen) > sessionIdleTimeout {
+					delete(sessions, key)
+				}
+			}
+			for address, request := range pending {
+				if currentTime.Sub(request.receivedAt) > pendingRequestTimeout {
+					delete(pending, address)
+				}
+			}
+		},
+	}
+}
+
+// the udp listener of the turn server, passing the sent messages to the auth sessions
+type observedPacketConn struct {
+	net.PacketConn
+	onResponse func(b []byte, dstAddr net.Addr)
+}
+
+func (conn *observedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn.onResponse(b, addr)
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+// the tcp listener of the turn server, the messages are written one at a time to the accepted connections
+type observedListener struct {
+	net.Listener
+	onResponse func(b []byte, dstAddr net.Addr)
+}
+
+func (listener *observedListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &observedConn{Conn: conn, onResponse: listener.onResponse}, nil
+}
+
+type observedConn struct {
+	net.Conn
+	onResponse func(b []byte, dstAddr net.Addr)
+}
+
+func (conn *observedConn) Write(b []byte) (int, error) {
+	conn.onResponse(b, conn.RemoteAddr())
+	return conn.Conn.Write(b)
+}
@@ -0,0 +1,164 @@
+package turnserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"signaling/main/auth"
+
+	"github.com/pion/turn/v2"
+)
+
+// the header of a STUN message of the type
+func stunMessage(messageType uint16) []byte {
+	b := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(b[0:2], messageType)
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	return b
+}
+
+func TestAuthSessions(t *testing.T) {
+	currentTime := time.Now()
+	sessions := newAuthSessions("secret", func() time.Time { return currentTime })
+	address := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+	otherAddress := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 50000}
+	thirdAddress := &net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 50000}
+
+	// valid until the end of the current second
+	expiry := time.Now().Unix()
+	username := strconv.FormatInt(expiry, 10) + ":viewer"
+	key, ok := sessions.authenticate(username, "realm", address)
+	if !ok {
+		t.Fatal("valid credentials rejected")
+	}
+	if !bytes.Equal(key, turn.GenerateAuthKey(username, "realm", auth.SignTurnUsername("secret", username))) {
+		t.Error("the key isn't derived from the signed username")
+	}
+	sessions.onResponse(stunMessage(allocateSuccessResponse), address)
+
+	// the message integrity of these requests fails, or they aren't Allocate or Refresh requests
+	if _, ok := sessions.authenticate(username, "realm", otherAddress); !ok {
+		t.Fatal("valid credentials rejected")
+	}
+	sessions.onResponse(stunMessage(0x0113), otherAddress)
+	if _, ok := sessions.authenticate(username, "realm", thirdAddress); !ok {
+		t.Fatal("valid credentials rejected")
+	}
+	sessions.onResponse(stunMessage(0x0108), thirdAddress)
+
+	time.Sleep(time.Until(time.Unix(expiry+1, 0)))
+	if !auth.IsTurnUsernameExpired(username) {
+		t.Fatal("the username didn't expire")
+	}
+
+	if _, ok := sessions.authenticate(username, "realm", otherAddress); ok {
+		t.Error("expired credentials accepted after a failed request")
+	}
+	if _, ok := sessions.authenticate(username, "realm", thirdAddress); ok {
+		t.Error("expired credentials accepted after a request other than Allocate or Refresh")
+	}
+	if _, ok := sessions.authenticate("1700000000:viewer", "realm", address); ok {
+		t.Error("expired credentials never used before accepted")
+	}
+
+	currentTime = currentTime.Add(10 * time.Minute)
+	sessions.prune()
+	if _, ok := sessions.authenticate(username, "realm", address); !ok {
+		t.Error("expired credentials of an allocation rejected")
+	}
+	sessions.onResponse(stunMessage(refreshSuccessResponse), address)
+
+	currentTime = currentTime.Add(10 * time.Minute)
+	sessions.prune()
+	if _, ok := sessions.authenticate(username, "realm", address); !ok {
+		t.Error("expired credentials of a refreshed allocation rejected")
+	}
+	// a Data indication isn't a response
+	sessions.onResponse(stunMessage(0x0017), address)
+
+	currentTime = currentTime.Add(sessionIdleTimeout + time.Second)
+	sessions.prune()
+	if _, ok := sessions.authenticate(username, "realm", address); ok {
+		t.Error("expired credentials accepted after the allocation timed out")
+	}
+}
+
+// the session of an allocation is recorded from the responses of a real turn server
+func TestAuthSessionsAllocate(t *testing.T) {
+	sessions := newAuthSessions("secret", time.Now)
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "realm",
+		AuthHandler: sessions.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: &observedPacketConn{PacketConn: serverConn, onResponse: sessions.onResponse},
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// valid until the end of the next second
+	credentials := auth.IssueTurnCredentials("secret", "viewer", time.Second)
+	allocate := func(password string) (net.Addr, error) {
+		clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := turn.NewClient(&turn.ClientConfig{
+			TURNServerAddr: serverConn.LocalAddr().String(),
+			STUNServerAddr: serverConn.LocalAddr().String(),
+			Username:       credentials.Username,
+			Password:       password,
+			Realm:          "realm",
+			Conn:           clientConn,
+			RTO:            100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		if err := client.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		relayConn, err := client.Allocate()
+		if err != nil {
+			return clientConn.LocalAddr(), err
+		}
+		return clientConn.LocalAddr(), relayConn.Close()
+	}
+
+	address, err := allocate(credentials.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongAddress, err := allocate("wrong password")
+	if err == nil {
+		t.Fatal("allocated with a wrong password")
+	}
+
+	time.Sleep(time.Until(credentials.ExpiresAt.Add(time.Second)))
+	if !auth.IsTurnUsernameExpired(credentials.Username) {
+		t.Fatal("the username didn't expire")
+	}
+	if _, ok := sessions.authenticate(credentials.Username, "realm", address); !ok {
+		t.Error("the session of the allocation isn't recorded")
+	}
+	if _, ok := sessions.authenticate(credentials.Username, "realm", wrongAddress); ok {
+		t.Error("a session is recorded for the allocation with a wrong password")
+	}
+}
@@ -102,7 +102,7 @@ func GetViewerId(c echo.Context) string {
 	return id_cookie.Value
 }
 func SortSignals(signals []rtc.Signal) []rtc.Signal {
-	//offers come before candidates
+	//offers come before candidates, the other signals(kick) come last
 	sortedSignals := make([]rtc.Signal, 0)
 	for _, signal := range signals {
 
@@ -115,5 +115,10 @@ func SortSignals(signals []rtc.Signal) []rtc.Signal {
 			sortedSignals = append(sortedSignals, signal)
 		}
 	}
+	for _, signal := range signals {
+		if signal.Type != "offer" && signal.Type != "candidate" {
+			sortedSignals = append(sortedSignals, signal)
+		}
+	}
 	return sortedSignals
 }
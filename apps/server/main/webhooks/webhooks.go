@@ -0,0 +1,173 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"signaling/main/utils"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+
+	EventStreamOnline         = "stream.online"
+	EventStreamOffline        = "stream.offline"
+	EventViewerConnected      = "viewer.connected"
+	EventViewerDisconnected   = "viewer.disconnected"
+	EventRemoteSessionStarted = "remote.session_started"
+
+	maxRetries       = 5
+	deliveryLogLimit = 100
+)
+
+type EventData struct {
+	StreamId string `json:"streamId"`
+	ViewerId string `json:"viewerId,omitempty"`
+}
+
+type Payload struct {
+	Id        string    `json:"id"`
+	Event     string    `json:"event"`
+	Timestamp int64     `json:"timestamp"`
+	Data      EventData `json:"data"`
+}
+
+type Delivery struct {
+	Id          string    `json:"id"`
+	Event       string    `json:"event"`
+	Url         string    `json:"url"`
+	Attempts    int       `json:"attempts"`
+	StatusCode  int       `json:"statusCode"`
+	Error       string    `json:"error,omitempty"`
+	Success     bool      `json:"success"`
+	CreatedAt   time.Time `json:"createdAt"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+type Dispatcher struct {
+	IsEnabled     bool
+	Send          func(event string, data EventData)
+	GetDeliveries func() []Delivery
+}
+
+// Sign returns the hex HMAC-SHA256 of the body, sent as "sha256=<signature>" in the signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewDispatcher posts the events to every url, the dispatcher is disabled without urls
+func NewDispatcher(urls []string, secret string) *Dispatcher {
+	// the most recent deliveries, oldest first
+	deliveries := make([]Delivery, 0)
+	deliveriesMutex := sync.Mutex{}
+
+	logDelivery := func(delivery Delivery) {
+		deliveriesMutex.Lock()
+		defer deliveriesMutex.Unlock()
+		deliveries = append(deliveries, delivery)
+		if len(deliveries) > deliveryLogLimit {
+			deliveries = deliveries[len(deliveries)-deliveryLogLimit:]
+		}
+	}
+
+	// retries with exponential backoff on network errors, 429 and 5xx responses
+	client := resty.New().
+		SetTimeout(10 * time.Second).
+		SetRetryCount(maxRetries).
+		SetRetryWaitTime(time.Second).
+		SetRetryMaxWaitTime(30 * time.Second).
+		AddRetryCondition(func(res *resty.Response, err error) bool {
+			if err != nil {
+				return true
+			}
+			return res.StatusCode() == http.StatusTooManyRequests || res.StatusCode() >= 500
+		})
+
+	deliver := func(url string, payload Payload, body []byte) {
+		delivery := Delivery{
+			Id:        payload.Id,
+			Event:     payload.Event,
+			Url:       url,
+			CreatedAt: time.Now(),
+		}
+
+		request := client.R().
+			SetHeader("Content-Type", "application/json").
+			SetHeader(EventHeader, payload.Event).
+			SetHeader(DeliveryHeader, payload.Id).
+			SetBody(body)
+		if secret != "" {
+			request.SetHeader(SignatureHeader, "sha256="+Sign(secret, body))
+		}
+
+		res, err := request.Post(url)
+
+		delivery.Attempts = request.Attempt
+		delivery.CompletedAt = time.Now()
+		if res != nil {
+			delivery.StatusCode = res.StatusCode()
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		} else if !res.IsSuccess() {
+			delivery.Error = res.Status()
+		}
+		delivery.Success = delivery.Error == ""
+
+		if delivery.Success {
+			log.Info().
+				Str("event", payload.Event).
+				Str("url", url).
+				Int("attempts", delivery.Attempts).
+				Msg("webhook delivered")
+		} else {
+			log.Error().
+				Str("event", payload.Event).
+				Str("url", url).
+				Int("attempts", delivery.Attempts).
+				Str("error", delivery.Error).
+				Msg("webhook delivery failed")
+		}
+		logDelivery(delivery)
+	}
+
+	return &Dispatcher{
+		IsEnabled: len(urls) > 0,
+		Send: func(event string, data EventData) {
+			if len(urls) == 0 {
+				return
+			}
+			payload := Payload{
+				Id:        utils.RandomStr(),
+				Event:     event,
+				Timestamp: time.Now().Unix(),
+				Data:      data,
+			}
+			body, err := json.Marshal(payload)
+			if err != nil {
+				log.Err(err).Send()
+				return
+			}
+			for _, url := range urls {
+				go deliver(url, payload, body)
+			}
+		},
+		GetDeliveries: func() []Delivery {
+			deliveriesMutex.Lock()
+			defer deliveriesMutex.Unlock()
+			return append([]Delivery{}, deliveries...)
+		},
+	}
+}
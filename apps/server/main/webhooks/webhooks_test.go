@@ -0,0 +1,78 @@
+package webhooks
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"stream.online"}`)
+	tests := []struct {
+		name   string
+		secret string
+		body   []byte
+		want   string
+	}{
+		// HMAC-SHA256 test vectors
+		{"valid", "secret", body, "66d772f0b1603f1551adb83b63a5dd89f208f24ddb754c7d25d5ae508384bde0"},
+		{"empty", "", []byte{}, "b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Sign(test.secret, test.body); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	signature := Sign("secret", body)
+	if Sign("secret", []byte(`{"event":"stream.offline"}`)) == signature {
+		t.Error("a tampered body has the same signature")
+	}
+	if Sign("other", body) == signature {
+		t.Error("another secret gives the same signature")
+	}
+}
+
+// the receiver verifies the signature header against the body it received
+func TestDispatcherSignsBody(t *testing.T) {
+	received := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.Header.Get(SignatureHeader) == "sha256="+Sign("secret", body) &&
+			r.Header.Get(EventHeader) == EventStreamOnline
+	}))
+	defer server.Close()
+
+	dispatcher := NewDispatcher([]string{server.URL}, "secret")
+	dispatcher.Send(EventStreamOnline, EventData{StreamId: "stream_test"})
+	select {
+	case valid := <-received:
+		if !valid {
+			t.Error("the signature or the event header is invalid")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't delivered")
+	}
+}
+
+func TestDispatcherWithoutSecret(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(SignatureHeader)
+	}))
+	defer server.Close()
+
+	NewDispatcher([]string{server.URL}, "").Send(EventStreamOffline, EventData{StreamId: "stream_test"})
+	select {
+	case signature := <-received:
+		if signature != "" {
+			t.Errorf("got signature %q without a secret", signature)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't delivered")
+	}
+}
@@ -13,6 +13,9 @@ import {
   Checkbox,
   CircularProgress,
   IconButton,
+  MenuItem,
+  Select,
+  SelectChangeEvent,
   Slider,
   Stack,
 } from '@mui/material';
@@ -49,6 +52,8 @@ export const Stream = () => {
   const [loading, setLoading] = useState(true);
   const [logLines, setLogLines] = useState<string[]>([]);
   const { volume, setVolume } = useStore();
+  const socketRef = useRef<ReturnType<typeof io>>();
+  const [layer, setLayer] = useState('auto');
 
   const handleVolumeChange = useCallback(
     (event: Event, value: number | number[]) => {
@@ -58,6 +63,15 @@ export const Stream = () => {
     },
     [],
   );
+  // the server forwards the pinned simulcast layer, if the capture client publishes them
+  const handleLayerChange = useCallback((event: SelectChangeEvent) => {
+    setLayer(event.target.value);
+    socketRef.current?.emit(
+      'signal',
+      JSON.stringify([{ type: 'layer', layer: event.target.value }]),
+    );
+  }, []);
+
   const cursorRef = useRef<HTMLDivElement>(null);
 
   const setCursorPosition = useCallback(({ x, y }) => {
@@ -90,13 +104,18 @@ export const Stream = () => {
   useEffect(() => {
     let pc: RTCPeerConnection;
     const controller = new AbortController();
+    // private streams need a viewer token or the viewer password
+    const searchParams = new URLSearchParams(window.location.search);
     const socket = io({
       path: '/api/socket',
       transports: ['polling'],
       query: {
         streamId,
+        token: searchParams.get('token') ?? '',
+        password: searchParams.get('password') ?? '',
       },
     });
+    socketRef.current = socket;
 
     socket.on('conn_ev', (event: any) => {
       console.log(event);
@@ -465,6 +484,18 @@ export const Stream = () => {
               icon={<MouseOutlinedIcon />}
               checkedIcon={<MouseIcon />}
             />
+            <Select
+              aria-label="Quality"
+              size="small"
+              value={layer}
+              onChange={handleLayerChange}
+              sx={{ color: grey[500] }}
+            >
+              <MenuItem value="auto">Auto</MenuItem>
+              <MenuItem value="f">High</MenuItem>
+              <MenuItem value="h">Medium</MenuItem>
+              <MenuItem value="q">Low</MenuItem>
+            </Select>
             <Box
               className="volume-container"
               sx={{
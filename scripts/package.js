@@ -229,6 +229,13 @@ STUN_SERVER_PASSWORD=
 TURN_SERVER_URL=
 TURN_SERVER_USERNAME=
 TURN_SERVER_PASSWORD=
+STREAM_KEY_SECRET=
+STREAM_REGISTRY_PATH=
+VIEWER_TOKEN_SECRET=
+ADMIN_TOKEN=
+METRICS_TOKEN=
+WEBHOOK_URLS=
+WEBHOOK_SECRET=
 `;
 
   writeFileSync(join(finalPath, 'config'), exampleConfig);
@@ -315,6 +322,13 @@ STUN_SERVER_PASSWORD=
 TURN_SERVER_URL=
 TURN_SERVER_USERNAME=
 TURN_SERVER_PASSWORD=
+STREAM_KEY_SECRET=
+STREAM_REGISTRY_PATH=
+VIEWER_TOKEN_SECRET=
+ADMIN_TOKEN=
+METRICS_TOKEN=
+WEBHOOK_URLS=
+WEBHOOK_SECRET=
 `;
 
   writeFileSync(join(finalPath, 'config'), exampleConfig);